@@ -0,0 +1,181 @@
+package addsvc
+
+// This file provides an adaptive concurrency limit per method, in the style
+// of the gradient limiters of Netflix's concurrency-limits. The limit grows
+// while latency stays close to its long term average and shrinks as soon as
+// it rises, that is as soon as calls start queueing somewhere, so that load
+// is shed before the backends collapse.
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// AdaptiveLimitSettings configures an AdaptiveLimiter.
+type AdaptiveLimitSettings struct {
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+	// Tolerance is how much the latency may exceed its long term average
+	// before the limit shrinks i.e. 1.5.
+	Tolerance float64
+	// Smoothing is the weight of a new limit estimate i.e. 0.2.
+	Smoothing float64
+}
+
+// DefaultAdaptiveLimitSettings are sensible settings for the gateway methods.
+var DefaultAdaptiveLimitSettings = AdaptiveLimitSettings{
+	InitialLimit: 100,
+	MinLimit:     10,
+	MaxLimit:     1000,
+	Tolerance:    1.5,
+	Smoothing:    0.2,
+}
+
+// The short and long term latency averages are exponential moving averages
+// over about 10 and 600 calls.
+const (
+	shortLatencyWeight = 2.0 / (10 + 1)
+	longLatencyWeight  = 2.0 / (600 + 1)
+)
+
+// AdaptiveLimiter limits the calls in flight to a method to a limit adjusted
+// after every call. It is safe for concurrent use.
+type AdaptiveLimiter struct {
+	settings AdaptiveLimitSettings
+	gauge    metrics.Gauge
+
+	mtx         sync.Mutex
+	limit       float64
+	inFlight    int
+	shortRTT    float64
+	longRTT     float64
+	maxInFlight int // since the last sample
+}
+
+// NewAdaptiveLimiter returns an AdaptiveLimiter exporting its current limit
+// to gauge.
+func NewAdaptiveLimiter(settings AdaptiveLimitSettings, gauge metrics.Gauge) *AdaptiveLimiter {
+	if settings.MinLimit < 1 {
+		settings.MinLimit = 1
+	}
+	if settings.MaxLimit < settings.MinLimit {
+		settings.MaxLimit = settings.MinLimit
+	}
+	l := &AdaptiveLimiter{settings: settings, gauge: gauge}
+	l.setLimit(float64(settings.InitialLimit))
+	return l
+}
+
+// Limit returns the current limit.
+func (l *AdaptiveLimiter) Limit() int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return int(l.limit)
+}
+
+func (l *AdaptiveLimiter) setLimit(limit float64) {
+	limit = math.Max(float64(l.settings.MinLimit), math.Min(limit, float64(l.settings.MaxLimit)))
+	l.limit = limit
+	l.gauge.Set(math.Floor(limit))
+}
+
+func (l *AdaptiveLimiter) acquire() bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.inFlight >= int(l.limit) {
+		return false
+	}
+	l.inFlight++
+	if l.inFlight > l.maxInFlight {
+		l.maxInFlight = l.inFlight
+	}
+	return true
+}
+
+// release ends a call. Calls failing because of an overloaded or timed out
+// backend shrink the limit straight away.
+func (l *AdaptiveLimiter) release(overloaded bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.inFlight--
+	if overloaded {
+		l.setLimit(l.limit * 0.9)
+	}
+}
+
+// Observe adjusts the limit to the latency of a successful call. It is meant
+// to be subscribed to the LatencyTracker fed by
+// EndpointInstrumentingMiddleware.
+func (l *AdaptiveLimiter) Observe(latency time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	rtt := float64(latency)
+	if l.longRTT == 0 {
+		l.shortRTT, l.longRTT = rtt, rtt
+		return
+	}
+	l.shortRTT += (rtt - l.shortRTT) * shortLatencyWeight
+	l.longRTT += (rtt - l.longRTT) * longLatencyWeight
+
+	// Recover faster from a long period of high latency
+	if l.longRTT/l.shortRTT > 2 {
+		l.longRTT *= 0.95
+	}
+
+	// Don't grow the limit while it is not reached, there is nothing to
+	// learn about the backend capacity
+	maxInFlight := l.maxInFlight
+	l.maxInFlight = l.inFlight
+	if float64(maxInFlight) < l.limit/2 {
+		return
+	}
+
+	gradient := math.Max(0.5, math.Min(1, l.settings.Tolerance*l.longRTT/l.shortRTT))
+	estimate := l.limit*gradient + math.Sqrt(l.limit)
+	l.setLimit(l.limit*(1-l.settings.Smoothing) + estimate*l.settings.Smoothing)
+}
+
+// AdaptiveLimitMiddleware returns an endpoint middleware rejecting the calls
+// to method beyond the limit of limiter with codes.ResourceExhausted (503 over
+// HTTP). Rejected calls are counted in rejected. Calls failing because of a
+// slow or overloaded backend shrink the limit, see slowBackend.
+func AdaptiveLimitMiddleware(limiter *AdaptiveLimiter, method string, rejected metrics.Counter) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			if !limiter.acquire() {
+				rejected.Add(1)
+				return nil, overloadError("method", method)
+			}
+
+			response, err = next(ctx, request)
+			limiter.release(slowBackend(ctx, err))
+			return response, err
+		}
+	}
+}
+
+// slowBackend returns whether err tells of a backend too slow or overloaded
+// to serve a call made with ctx. The rejections of the gateway itself, like
+// an open circuit breaker, and the caller giving up or running out of time
+// say nothing about the latency of the backend.
+func slowBackend(ctx context.Context, err error) bool {
+	if err == nil || isRejection(err) || callerFault(ctx, err) {
+		return false
+	}
+	switch grpc.Code(err) {
+	case codes.DeadlineExceeded, codes.ResourceExhausted, codes.Unavailable:
+		return true
+	}
+	return err == context.DeadlineExceeded
+}
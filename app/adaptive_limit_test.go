@@ -0,0 +1,149 @@
+package addsvc
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/discard"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestAdaptiveLimitMiddleware(t *testing.T) {
+	limiter := NewAdaptiveLimiter(AdaptiveLimitSettings{InitialLimit: 1, MinLimit: 1, MaxLimit: 10, Tolerance: 1.5, Smoothing: 0.2}, discard.NewGauge())
+
+	release := make(chan struct{})
+	e := AdaptiveLimitMiddleware(limiter, "SayHello", discard.NewCounter())(func(ctx context.Context, _ interface{}) (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+
+	done := make(chan error)
+	go func() {
+		_, err := e(context.Background(), nil)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	_, err := e(context.Background(), nil)
+	if grpc.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("want ResourceExhausted, have %v", err)
+	}
+	rec := httptest.NewRecorder()
+	errorEncoder(context.Background(), err, rec)
+	if rec.Code != 503 {
+		t.Errorf("want 503, have %d", rec.Code)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdaptiveLimiterGradient(t *testing.T) {
+	limiter := NewAdaptiveLimiter(AdaptiveLimitSettings{InitialLimit: 20, MinLimit: 5, MaxLimit: 100, Tolerance: 1.5, Smoothing: 0.2}, discard.NewGauge())
+	fill := func() {
+		// Keep the limiter busy, the limit only grows when it is reached
+		limiter.mtx.Lock()
+		limiter.maxInFlight = int(limiter.limit)
+		limiter.mtx.Unlock()
+	}
+
+	// Steady latency: the limit grows
+	for i := 0; i < 50; i++ {
+		fill()
+		limiter.Observe(10 * time.Millisecond)
+	}
+	grown := limiter.Limit()
+	if grown <= 20 {
+		t.Fatalf("want the limit to grow above 20, have %d", grown)
+	}
+
+	// Latency rising well beyond the tolerance: the limit shrinks
+	for i := 0; i < 50; i++ {
+		fill()
+		limiter.Observe(100 * time.Millisecond)
+	}
+	if have := limiter.Limit(); have >= grown {
+		t.Errorf("want the limit to shrink below %d, have %d", grown, have)
+	}
+}
+
+func TestAdaptiveLimiterIdle(t *testing.T) {
+	limiter := NewAdaptiveLimiter(AdaptiveLimitSettings{InitialLimit: 20, MinLimit: 5, MaxLimit: 100, Tolerance: 1.5, Smoothing: 0.2}, discard.NewGauge())
+	for i := 0; i < 50; i++ {
+		limiter.Observe(10 * time.Millisecond)
+	}
+	if have := limiter.Limit(); have != 20 {
+		t.Errorf("want an idle limiter to keep its limit of 20, have %d", have)
+	}
+}
+
+func TestAdaptiveLimiterOverload(t *testing.T) {
+	limiter := NewAdaptiveLimiter(AdaptiveLimitSettings{InitialLimit: 20, MinLimit: 5, MaxLimit: 100, Tolerance: 1.5, Smoothing: 0.2}, discard.NewGauge())
+	e := AdaptiveLimitMiddleware(limiter, "SayHello", discard.NewCounter())(func(ctx context.Context, _ interface{}) (interface{}, error) {
+		return nil, grpc.Errorf(codes.Unavailable, "overloaded")
+	})
+	for i := 0; i < 30; i++ {
+		e(context.Background(), nil)
+	}
+	if have := limiter.Limit(); have != 5 {
+		t.Errorf("want the limit to drop to its minimum of 5, have %d", have)
+	}
+}
+
+func TestAdaptiveLimiterBreakerOpen(t *testing.T) {
+	limiter := NewAdaptiveLimiter(AdaptiveLimitSettings{InitialLimit: 20, MinLimit: 5, MaxLimit: 100, Tolerance: 1.5, Smoothing: 0.2}, discard.NewGauge())
+	breaker := NewCircuitBreaker("grpc_types.Hello", BreakerSettings{ConsecutiveFailures: 1, OpenTimeout: time.Minute}, discard.NewGauge(), log.NewNopLogger())
+	breaker.setState(BreakerOpen, breaker.now())
+
+	calls := 0
+	e := AdaptiveLimitMiddleware(limiter, "SayHello", discard.NewCounter())(CircuitBreakerMiddleware(breaker)(func(context.Context, interface{}) (interface{}, error) {
+		calls++
+		return nil, nil
+	}))
+	for i := 0; i < 30; i++ {
+		if _, err := e(context.Background(), nil); grpc.Code(err) != codes.Unavailable {
+			t.Fatalf("want Unavailable from the open breaker, have %v", err)
+		}
+	}
+	if calls != 0 {
+		t.Errorf("want no call through the open breaker, have %d", calls)
+	}
+	if have := limiter.Limit(); have != 20 {
+		t.Errorf("want the limit to stay at 20, have %d", have)
+	}
+}
+
+func TestAdaptiveLimiterNotOverloaded(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		err  error
+	}{
+		{"full bulkhead", context.Background(), overloadError("backend", "grpc_types.Hello")},
+		{"no instances", context.Background(), rejectionError(codes.Unavailable, "backend", "grpc_types.Hello", "no instances of grpc_types.Hello")},
+		{"caller canceled", canceled, context.Canceled},
+		{"caller deadline", expired, grpc.Errorf(codes.DeadlineExceeded, "context deadline exceeded")},
+	} {
+		limiter := NewAdaptiveLimiter(AdaptiveLimitSettings{InitialLimit: 20, MinLimit: 5, MaxLimit: 100, Tolerance: 1.5, Smoothing: 0.2}, discard.NewGauge())
+		e := AdaptiveLimitMiddleware(limiter, "SayHello", discard.NewCounter())(func(context.Context, interface{}) (interface{}, error) {
+			return nil, tc.err
+		})
+		for i := 0; i < 30; i++ {
+			e(tc.ctx, nil)
+		}
+		if have := limiter.Limit(); have != 20 {
+			t.Errorf("%s: want the limit to stay at 20, have %d", tc.name, have)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package addsvc
+
+// This file provides static API key authentication for integrations that
+// cannot obtain JWTs. Keys are taken from the X-API-Key header (HTTP) or the
+// x-api-key metadata (gRPC) and looked up in a KeyStore, which only ever
+// holds the SHA-256 hashes of the keys.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type apiKeyContextKey int
+
+const (
+	// apiKeyTokenContextKey holds the raw key sent by the caller.
+	apiKeyTokenContextKey apiKeyContextKey = iota
+	// apiKeyMetadataContextKey holds the APIKey of an authenticated caller.
+	apiKeyMetadataContextKey
+)
+
+// ErrUnknownAPIKey is returned by a KeyStore for keys it does not hold.
+var ErrUnknownAPIKey = errors.New("unknown API key")
+
+// APIKey is the metadata of an API key.
+type APIKey struct {
+	Owner    string   `toml:"owner"`
+	Tenant   string   `toml:"tenant"`    // quota tenant, see QuotaMiddleware
+	Routes   []string `toml:"routes"`    // methods the key may call i.e. AddTask, "*" for any
+	RateTier string   `toml:"rate_tier"` // i.e. standard
+}
+
+// Allows reports whether the key may call method.
+func (k APIKey) Allows(method string) bool {
+	for _, route := range k.Routes {
+		if route == "*" || route == method {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyStore looks up the metadata of an API key.
+type KeyStore interface {
+	Lookup(ctx context.Context, key string) (APIKey, error)
+}
+
+// HashAPIKey returns the hex encoded SHA-256 hash of key, as stored in a key
+// file. It is the same as `printf %s "$KEY" | sha256sum`.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// FileKeyStore is a KeyStore backed by a TOML file i.e.
+//
+//	[[key]]
+//	hash = "<sha256 of the key>"
+//	owner = "crm-integration"
+//	tenant = "acme"
+//	routes = ["AddTask", "Ping"]
+//	rate_tier = "standard"
+//
+// The file is reloaded by Watch when it changes.
+type FileKeyStore struct {
+	filename string
+
+	mtx     sync.RWMutex
+	keys    map[string]APIKey
+	modTime time.Time
+}
+
+// NewFileKeyStore returns a FileKeyStore loaded from filename.
+func NewFileKeyStore(filename string) (*FileKeyStore, error) {
+	s := &FileKeyStore{filename: filename}
+	if _, err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Lookup implements KeyStore.
+func (s *FileKeyStore) Lookup(_ context.Context, key string) (APIKey, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	k, ok := s.keys[HashAPIKey(key)]
+	if !ok {
+		return APIKey{}, ErrUnknownAPIKey
+	}
+	return k, nil
+}
+
+// Reload reads the key file again if it was modified since it was last
+// loaded, and reports whether it did. The keys in use are kept if the file is
+// invalid.
+func (s *FileKeyStore) Reload() (bool, error) {
+	info, err := os.Stat(s.filename)
+	if err != nil {
+		return false, err
+	}
+
+	s.mtx.RLock()
+	unchanged := s.keys != nil && info.ModTime().Equal(s.modTime)
+	s.mtx.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	var file struct {
+		Keys []struct {
+			Hash string `toml:"hash"`
+			APIKey
+		} `toml:"key"`
+	}
+	if _, err := toml.DecodeFile(s.filename, &file); err != nil {
+		return false, err
+	}
+
+	keys := map[string]APIKey{}
+	for i, k := range file.Keys {
+		hash := strings.ToLower(k.Hash)
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return false, fmt.Errorf("%s: key %d (%s): hash must be a hex encoded SHA-256", s.filename, i, k.Owner)
+		}
+		keys[hash] = k.APIKey
+	}
+
+	s.mtx.Lock()
+	s.keys = keys
+	s.modTime = info.ModTime()
+	s.mtx.Unlock()
+	return true, nil
+}
+
+// Watch checks the key file for changes every interval until ctx is done.
+func (s *FileKeyStore) Watch(ctx context.Context, interval time.Duration, logger log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := s.Reload()
+			if err != nil {
+				logger.Log("level", "error", "msg", "failed to reload the API keys, keeping the previous ones", "file", s.filename, "err", err)
+				continue
+			}
+			if reloaded {
+				logger.Log("level", "info", "msg", "reloaded the API keys", "file", s.filename)
+			}
+		}
+	}
+}
+
+// APIKeyHTTPToContext moves the X-API-Key header of the request into the
+// context.
+func APIKeyHTTPToContext() httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			return ctx
+		}
+		return context.WithValue(ctx, apiKeyTokenContextKey, key)
+	}
+}
+
+// APIKeyGRPCToContext moves the x-api-key metadata of the request into the
+// context.
+func APIKeyGRPCToContext() grpctransport.ServerRequestFunc {
+	return func(ctx context.Context, md metadata.MD) context.Context {
+		keys := md["x-api-key"]
+		if len(keys) == 0 || keys[0] == "" {
+			return ctx
+		}
+		return context.WithValue(ctx, apiKeyTokenContextKey, keys[0])
+	}
+}
+
+// APIKeyAuthMiddleware returns an endpoint middleware rejecting requests
+// without a known API key with codes.Unauthenticated (401 over HTTP). The key
+// must have been put in the context by APIKeyHTTPToContext or
+// APIKeyGRPCToContext. The key metadata is put in the context, see
+// APIKeyFromContext.
+func APIKeyAuthMiddleware(store KeyStore) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			key, ok := ctx.Value(apiKeyTokenContextKey).(string)
+			if !ok {
+				return nil, status.Error(codes.Unauthenticated, "missing API key")
+			}
+
+			k, err := store.Lookup(ctx, key)
+			if err == ErrUnknownAPIKey {
+				return nil, status.Error(codes.Unauthenticated, err.Error())
+			}
+			if err != nil {
+				return nil, status.Errorf(codes.Unavailable, "API key lookup failed: %v", err)
+			}
+
+			ctx = context.WithValue(ctx, apiKeyMetadataContextKey, k)
+			return next(ctx, request)
+		}
+	}
+}
+
+// APIKeyOrBearerMiddleware returns an endpoint middleware authenticating
+// requests carrying an API key with apiKey, and every other request with
+// bearer.
+func APIKeyOrBearerMiddleware(apiKey, bearer endpoint.Middleware) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		withAPIKey, withBearer := apiKey(next), bearer(next)
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			if _, ok := ctx.Value(apiKeyTokenContextKey).(string); ok {
+				return withAPIKey(ctx, request)
+			}
+			return withBearer(ctx, request)
+		}
+	}
+}
+
+// APIKeyFromContext returns the metadata of the key validated by
+// APIKeyAuthMiddleware.
+func APIKeyFromContext(ctx context.Context) (APIKey, bool) {
+	k, ok := ctx.Value(apiKeyMetadataContextKey).(APIKey)
+	return k, ok
+}
@@ -0,0 +1,114 @@
+package addsvc
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func writeTestKeyFile(t *testing.T, filename, content string) {
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileKeyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apikeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := dir + "/apikeys.toml"
+
+	writeTestKeyFile(t, filename, `
+[[key]]
+hash = "`+HashAPIKey("first")+`"
+owner = "crm"
+routes = ["AddTask"]
+rate_tier = "standard"
+`)
+	store, err := NewFileKeyStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := store.Lookup(context.Background(), "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Owner != "crm" || k.RateTier != "standard" || !k.Allows("AddTask") || k.Allows("Ping") {
+		t.Errorf("unexpected key metadata %+v", k)
+	}
+	if _, err := store.Lookup(context.Background(), "second"); err != ErrUnknownAPIKey {
+		t.Errorf("want ErrUnknownAPIKey, have %v", err)
+	}
+
+	// An invalid file keeps the previous keys
+	writeTestKeyFile(t, filename, `[[key]]
+hash = "not a hash"`)
+	os.Chtimes(filename, time.Now(), time.Now().Add(time.Second))
+	if _, err := store.Reload(); err == nil {
+		t.Error("want an error for an invalid hash")
+	}
+	if _, err := store.Lookup(context.Background(), "first"); err != nil {
+		t.Errorf("want the previous keys to be kept, have %v", err)
+	}
+
+	writeTestKeyFile(t, filename, `[[key]]
+hash = "`+HashAPIKey("second")+`"
+owner = "billing"
+routes = ["*"]`)
+	os.Chtimes(filename, time.Now(), time.Now().Add(2*time.Second))
+	if reloaded, err := store.Reload(); err != nil || !reloaded {
+		t.Fatalf("want the file to be reloaded, have %v, %v", reloaded, err)
+	}
+	if _, err := store.Lookup(context.Background(), "first"); err != ErrUnknownAPIKey {
+		t.Errorf("want the first key to be removed, have %v", err)
+	}
+	if k, err := store.Lookup(context.Background(), "second"); err != nil || !k.Allows("Ping") {
+		t.Errorf("want the second key to allow any route, have %+v, %v", k, err)
+	}
+}
+
+type mapKeyStore map[string]APIKey
+
+func (s mapKeyStore) Lookup(_ context.Context, key string) (APIKey, error) {
+	k, ok := s[key]
+	if !ok {
+		return APIKey{}, ErrUnknownAPIKey
+	}
+	return k, nil
+}
+
+func TestAPIKeyAuthMiddleware(t *testing.T) {
+	store := mapKeyStore{"valid": {Owner: "crm"}}
+
+	var owner string
+	e := APIKeyAuthMiddleware(store)(func(ctx context.Context, request interface{}) (interface{}, error) {
+		k, _ := APIKeyFromContext(ctx)
+		owner = k.Owner
+		return nil, nil
+	})
+
+	ctx := context.WithValue(context.Background(), apiKeyTokenContextKey, "valid")
+	if _, err := e(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if owner != "crm" {
+		t.Errorf("want key metadata in the context, have owner %q", owner)
+	}
+
+	for name, ctx := range map[string]context.Context{
+		"unknown": context.WithValue(context.Background(), apiKeyTokenContextKey, "invalid"),
+		"missing": context.Background(),
+	} {
+		if _, err := e(ctx, nil); grpc.Code(err) != codes.Unauthenticated {
+			t.Errorf("%s: want Unauthenticated, have %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package addsvc
+
+// This file provides JWT bearer token authentication. Tokens are taken from
+// the Authorization header (HTTP) or metadata (gRPC) by the go-kit
+// auth/jwt HTTPToContext and GRPCToContext request funcs, and validated by
+// an endpoint middleware against a key set loaded from a local JWKS file.
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	kitjwt "github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/endpoint"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// KeySet holds the keys JWTs may be signed with, indexed by key ID. HS256
+// tokens are checked against symmetric ("oct") keys and RS256 tokens against
+// RSA public keys; a token can never be checked against a key of the other
+// kind.
+type KeySet struct {
+	hmac map[string][]byte
+	rsa  map[string]*rsa.PublicKey
+}
+
+// jsonWebKey is the subset of RFC 7517 needed for HS256 and RS256 keys.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// LoadJWKS reads a JSON Web Key Set file i.e.
+//
+//	{"keys": [{"kty": "RSA", "kid": "agents", "n": "...", "e": "AQAB"},
+//	          {"kty": "oct", "kid": "internal", "k": "..."}]}
+//
+// Keys with a use other than "sig" and unsupported key types are skipped.
+func LoadJWKS(filename string) (*KeySet, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &jwks); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	keys := &KeySet{hmac: map[string][]byte{}, rsa: map[string]*rsa.PublicKey{}}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		switch jwk.Kty {
+		case "oct":
+			k, err := decodeBase64URL(jwk.K)
+			if err != nil {
+				return nil, fmt.Errorf("%s: key %q: %v", filename, jwk.Kid, err)
+			}
+			keys.hmac[jwk.Kid] = k
+
+		case "RSA":
+			n, err := decodeBase64URL(jwk.N)
+			if err != nil {
+				return nil, fmt.Errorf("%s: key %q: %v", filename, jwk.Kid, err)
+			}
+			e, err := decodeBase64URL(jwk.E)
+			if err != nil {
+				return nil, fmt.Errorf("%s: key %q: %v", filename, jwk.Kid, err)
+			}
+			keys.rsa[jwk.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		}
+	}
+
+	if len(keys.hmac) == 0 && len(keys.rsa) == 0 {
+		return nil, fmt.Errorf("%s: no HS256 or RS256 signing keys", filename)
+	}
+	return keys, nil
+}
+
+// Keyfunc is a jwt.Keyfunc returning the key matching the token's "kid"
+// header and signing method. Tokens without a "kid" are accepted when the
+// key set holds a single key of the right kind.
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	switch token.Method {
+	case jwt.SigningMethodHS256:
+		if key, ok := ks.hmac[kid]; ok {
+			return key, nil
+		}
+		if kid == "" && len(ks.hmac) == 1 {
+			for _, key := range ks.hmac {
+				return key, nil
+			}
+		}
+	case jwt.SigningMethodRS256:
+		if key, ok := ks.rsa[kid]; ok {
+			return key, nil
+		}
+		if kid == "" && len(ks.rsa) == 1 {
+			for _, key := range ks.rsa {
+				return key, nil
+			}
+		}
+	default:
+		return nil, kitjwt.ErrUnexpectedSigningMethod
+	}
+
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// JWTAuthMiddleware returns an endpoint middleware rejecting requests without
+// a valid bearer token with codes.Unauthenticated (401 over HTTP). The token
+// must have been put in the context by kitjwt.HTTPToContext or
+// kitjwt.GRPCToContext. The claims of a valid token are put in the context,
+// see ClaimsFromContext.
+func JWTAuthMiddleware(keys *KeySet) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			tokenString, ok := ctx.Value(kitjwt.JWTTokenContextKey).(string)
+			if !ok {
+				return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+			}
+
+			claims, err := parseJWT(keys, tokenString)
+			if err != nil {
+				return nil, status.Error(codes.Unauthenticated, err.Error())
+			}
+
+			ctx = context.WithValue(ctx, kitjwt.JWTClaimsContextKey, claims)
+			return next(ctx, request)
+		}
+	}
+}
+
+// ClaimsFromContext returns the claims of the token validated by
+// JWTAuthMiddleware.
+func ClaimsFromContext(ctx context.Context) (jwt.MapClaims, bool) {
+	claims, ok := ctx.Value(kitjwt.JWTClaimsContextKey).(jwt.MapClaims)
+	return claims, ok
+}
+
+func parseJWT(keys *KeySet, tokenString string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, keys.Keyfunc)
+	if err != nil {
+		if e, ok := err.(*jwt.ValidationError); ok {
+			switch {
+			case e.Errors&jwt.ValidationErrorMalformed != 0:
+				return nil, kitjwt.ErrTokenMalformed
+			case e.Errors&jwt.ValidationErrorExpired != 0:
+				return nil, kitjwt.ErrTokenExpired
+			case e.Errors&jwt.ValidationErrorNotValidYet != 0:
+				return nil, kitjwt.ErrTokenNotActive
+			case e.Inner != nil:
+				return nil, e.Inner
+			}
+		}
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, kitjwt.ErrTokenInvalid
+	}
+
+	return claims, nil
+}
+
+func decodeBase64URL(s string) ([]byte, error) {
+	if s == "" {
+		return nil, errors.New("empty key material")
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
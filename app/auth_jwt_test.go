@@ -0,0 +1,81 @@
+package addsvc
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	kitjwt "github.com/go-kit/kit/auth/jwt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// "secret" base64url encoded
+const testJWKS = `{"keys": [{"kty": "oct", "kid": "test", "k": "c2VjcmV0"}]}`
+
+func loadTestKeySet(t *testing.T) *KeySet {
+	f, err := ioutil.TempFile("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(testJWKS); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	keys, err := LoadJWKS(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func signTestToken(t *testing.T, key []byte, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = "test"
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestJWTAuthMiddleware(t *testing.T) {
+	keys := loadTestKeySet(t)
+
+	var subject interface{}
+	e := JWTAuthMiddleware(keys)(func(ctx context.Context, request interface{}) (interface{}, error) {
+		claims, _ := ClaimsFromContext(ctx)
+		subject = claims["sub"]
+		return request, nil
+	})
+
+	valid := signTestToken(t, []byte("secret"), jwt.MapClaims{"sub": "agent-1", "exp": time.Now().Add(time.Hour).Unix()})
+	ctx := context.WithValue(context.Background(), kitjwt.JWTTokenContextKey, valid)
+	if _, err := e(ctx, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want, have := "agent-1", subject; want != have {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	for name, token := range map[string]string{
+		"wrong key": signTestToken(t, []byte("other"), jwt.MapClaims{"sub": "agent-1"}),
+		"expired":   signTestToken(t, []byte("secret"), jwt.MapClaims{"sub": "agent-1", "exp": time.Now().Add(-time.Hour).Unix()}),
+		"malformed": "not-a-jwt",
+	} {
+		ctx := context.WithValue(context.Background(), kitjwt.JWTTokenContextKey, token)
+		if _, err := e(ctx, nil); grpc.Code(err) != codes.Unauthenticated {
+			t.Errorf("%s: want Unauthenticated, have %v", name, err)
+		}
+	}
+
+	if _, err := e(context.Background(), nil); grpc.Code(err) != codes.Unauthenticated {
+		t.Errorf("missing token: want Unauthenticated, have %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package addsvc
+
+// This file provides per-method authorization based on the claims of the
+// caller's token. The policy is declarative, loaded from a TOML file i.e.
+//
+//   [default]
+//   roles = ["admin"]
+//
+//   [methods.HeartBeat]
+//   roles = ["agent"]
+//
+//   [methods.AddTask]
+//   roles = ["dispatcher"]
+//   scopes = ["tasks:write"]
+//
+//   [methods.Ping]
+//   allow_all = true
+
+import (
+	"context"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	kitjwt "github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Rule grants access to callers holding any of Roles (the "roles" claim) or
+// any of Scopes (the space separated "scope" claim). AllowAll grants access
+// to every caller, authenticated or not, provided authentication is wrapped
+// by Policy.Authenticate. An empty rule denies everyone.
+type Rule struct {
+	Roles    []string `toml:"roles"`
+	Scopes   []string `toml:"scopes"`
+	AllowAll bool     `toml:"allow_all"`
+}
+
+// Policy holds the rule of each gateway method, keyed by method name i.e.
+// HeartBeat. Methods without a rule fall back to Default.
+type Policy struct {
+	Default Rule            `toml:"default"`
+	Methods map[string]Rule `toml:"methods"`
+}
+
+// LoadPolicy reads a TOML authorization policy file.
+func LoadPolicy(filename string) (*Policy, error) {
+	var p Policy
+	if _, err := toml.DecodeFile(filename, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Rule returns the rule applying to method.
+func (p *Policy) Rule(method string) Rule {
+	if rule, ok := p.Methods[method]; ok {
+		return rule
+	}
+	return p.Default
+}
+
+// Authenticate returns the authentication middleware of method: authenticate
+// itself, except for the methods allowed to all callers, where only the
+// callers presenting a bearer token or an API key are authenticated, and
+// anonymous callers go through.
+func (p *Policy) Authenticate(method string, authenticate endpoint.Middleware) endpoint.Middleware {
+	if !p.Rule(method).AllowAll {
+		return authenticate
+	}
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		authenticated := authenticate(next)
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			_, bearer := ctx.Value(kitjwt.JWTTokenContextKey).(string)
+			_, apiKey := ctx.Value(apiKeyTokenContextKey).(string)
+			if bearer || apiKey {
+				return authenticated(ctx, request)
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// AuthorizationMiddleware returns an endpoint middleware enforcing the
+// policy rule of method. Callers without claims are rejected with
+// codes.Unauthenticated, callers whose claims are not granted access with
+// codes.PermissionDenied (403 over HTTP). Callers authenticated with an API
+// key are only allowed the routes of their key, regardless of the policy.
+// Every decision is written to the logger as an audit line. It must be
+// wrapped by the authentication middleware, which puts the claims or the API
+// key in the context.
+func AuthorizationMiddleware(policy *Policy, method string, logger log.Logger) endpoint.Middleware {
+	rule := policy.Rule(method)
+	logger = log.With(logger, "tag", "#audit", "method", method)
+
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			if key, ok := APIKeyFromContext(ctx); ok {
+				if !key.Allows(method) {
+					logger.Log("level", "warn", "decision", "deny", "owner", key.Owner, "reason", "route not allowed for the API key")
+					return nil, status.Errorf(codes.PermissionDenied, "API key of %s is not allowed to call %s", key.Owner, method)
+				}
+				logger.Log("level", "info", "decision", "allow", "owner", key.Owner)
+				return next(ctx, request)
+			}
+
+			claims, ok := ClaimsFromContext(ctx)
+			if rule.AllowAll {
+				subject, _ := claims["sub"].(string)
+				logger.Log("level", "info", "decision", "allow", "subject", subject, "reason", "allowed to all")
+				return next(ctx, request)
+			}
+			if !ok {
+				logger.Log("level", "warn", "decision", "deny", "reason", "unauthenticated")
+				return nil, status.Error(codes.Unauthenticated, "authentication required")
+			}
+
+			subject, _ := claims["sub"].(string)
+			if !rule.allows(claimStrings(claims["roles"]), strings.Fields(claimString(claims["scope"]))) {
+				logger.Log("level", "warn", "decision", "deny", "subject", subject, "reason", "missing role or scope")
+				return nil, status.Errorf(codes.PermissionDenied, "%s is not allowed to call %s", subject, method)
+			}
+
+			logger.Log("level", "info", "decision", "allow", "subject", subject)
+			return next(ctx, request)
+		}
+	}
+}
+
+func (r Rule) allows(roles, scopes []string) bool {
+	for _, want := range r.Roles {
+		for _, have := range roles {
+			if want == have {
+				return true
+			}
+		}
+	}
+	for _, want := range r.Scopes {
+		for _, have := range scopes {
+			if want == have {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimStrings returns a claim holding either a single string or a list of
+// strings as a list.
+func claimStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func claimString(claim interface{}) string {
+	s, _ := claim.(string)
+	return s
+}
@@ -0,0 +1,115 @@
+package addsvc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	kitjwt "github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestAuthorizationMiddleware(t *testing.T) {
+	policy := &Policy{
+		Default: Rule{Roles: []string{"admin"}},
+		Methods: map[string]Rule{
+			"Ping":      {AllowAll: true},
+			"HeartBeat": {Roles: []string{"agent"}},
+			"AddTask":   {Roles: []string{"dispatcher"}, Scopes: []string{"tasks:write"}},
+		},
+	}
+
+	agent := jwt.MapClaims{"sub": "agent-1", "roles": []interface{}{"agent"}}
+	dispatcher := jwt.MapClaims{"sub": "dispatcher-1", "roles": "dispatcher"}
+	service := jwt.MapClaims{"sub": "service-1", "scope": "tasks:read tasks:write"}
+
+	for _, tc := range []struct {
+		method string
+		claims jwt.MapClaims
+		want   codes.Code
+	}{
+		{"Ping", nil, codes.OK},
+		{"HeartBeat", agent, codes.OK},
+		{"HeartBeat", dispatcher, codes.PermissionDenied},
+		{"HeartBeat", nil, codes.Unauthenticated},
+		{"AddTask", dispatcher, codes.OK},
+		{"AddTask", service, codes.OK},
+		{"AddTask", agent, codes.PermissionDenied},
+		{"SayHello", agent, codes.PermissionDenied},
+	} {
+		e := AuthorizationMiddleware(policy, tc.method, log.NewNopLogger())(func(context.Context, interface{}) (interface{}, error) {
+			return nil, nil
+		})
+
+		ctx := context.Background()
+		if tc.claims != nil {
+			ctx = context.WithValue(ctx, kitjwt.JWTClaimsContextKey, tc.claims)
+		}
+		_, err := e(ctx, nil)
+		if got := grpc.Code(err); got != tc.want {
+			t.Errorf("%s with %v: want %v, have %v", tc.method, tc.claims, tc.want, got)
+		}
+	}
+}
+
+func TestAuthorizationMiddlewareAPIKey(t *testing.T) {
+	policy := &Policy{Methods: map[string]Rule{"Ping": {AllowAll: true}}}
+	ctx := context.WithValue(context.Background(), apiKeyMetadataContextKey, APIKey{Owner: "crm", Routes: []string{"AddTask"}})
+
+	for method, want := range map[string]codes.Code{
+		"AddTask": codes.OK,
+		"Ping":    codes.PermissionDenied,
+	} {
+		e := AuthorizationMiddleware(policy, method, log.NewNopLogger())(func(context.Context, interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		if _, err := e(ctx, nil); grpc.Code(err) != want {
+			t.Errorf("%s: want %v, have %v", method, want, grpc.Code(err))
+		}
+	}
+}
+
+func TestPolicyAuthenticate(t *testing.T) {
+	policy := &Policy{
+		Default: Rule{Roles: []string{"admin"}},
+		Methods: map[string]Rule{"Ping": {AllowAll: true}},
+	}
+	var audit []string
+	logger := log.LoggerFunc(func(keyvals ...interface{}) error {
+		audit = append(audit, fmt.Sprint(keyvals...))
+		return nil
+	})
+	authenticate := JWTAuthMiddleware(&KeySet{})
+
+	for _, tc := range []struct {
+		method string
+		token  string
+		want   codes.Code
+	}{
+		{"Ping", "", codes.OK},
+		{"Ping", "not.a.jwt", codes.Unauthenticated},
+		{"HeartBeat", "", codes.Unauthenticated},
+	} {
+		e := AuthorizationMiddleware(policy, tc.method, logger)(func(context.Context, interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		e = policy.Authenticate(tc.method, authenticate)(e)
+
+		ctx := context.Background()
+		if tc.token != "" {
+			ctx = context.WithValue(ctx, kitjwt.JWTTokenContextKey, tc.token)
+		}
+		if _, err := e(ctx, nil); grpc.Code(err) != tc.want {
+			t.Errorf("%s with token %q: want %v, have %v", tc.method, tc.token, tc.want, grpc.Code(err))
+		}
+	}
+
+	// The anonymous call allowed to all is audited too
+	if len(audit) != 1 || !strings.Contains(audit[0], "allowed to all") {
+		t.Errorf("want the anonymous Ping audited, have %q", audit)
+	}
+}
@@ -0,0 +1,109 @@
+package addsvc
+
+// This file provides the load balancers picking the backend instance serving
+// each call.
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Balancer picks the instance serving a call among the available instances
+// of a backend, of which there is at least one. Pick is called with the
+// backend locked, so a Balancer needs no locking of its own, but a Balancer
+// must not be shared by backends.
+type Balancer interface {
+	Pick(instances []*BackendInstance) *BackendInstance
+}
+
+// Balancers maps the balancer names to their constructors.
+var Balancers = map[string]func() Balancer{
+	"round_robin":       NewRoundRobinBalancer,
+	"least_outstanding": NewLeastOutstandingBalancer,
+	"p2c":               NewPowerOfTwoChoicesBalancer,
+}
+
+// ParseBalancer returns the constructor of the balancer name i.e.
+// round_robin.
+func ParseBalancer(name string) (func() Balancer, error) {
+	if newBalancer, ok := Balancers[name]; ok {
+		return newBalancer, nil
+	}
+	var names []string
+	for name := range Balancers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown balancer %q, want one of %s", name, strings.Join(names, ", "))
+}
+
+type roundRobinBalancer struct {
+	next int
+}
+
+// NewRoundRobinBalancer returns a Balancer picking the instances in turn.
+func NewRoundRobinBalancer() Balancer {
+	return &roundRobinBalancer{}
+}
+
+func (b *roundRobinBalancer) Pick(instances []*BackendInstance) *BackendInstance {
+	b.next = (b.next + 1) % len(instances)
+	return instances[b.next]
+}
+
+type leastOutstandingBalancer struct {
+	rand *rand.Rand
+}
+
+// NewLeastOutstandingBalancer returns a Balancer picking the instance with
+// the fewest calls in flight, at random among equals.
+func NewLeastOutstandingBalancer() Balancer {
+	return &leastOutstandingBalancer{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (b *leastOutstandingBalancer) Pick(instances []*BackendInstance) *BackendInstance {
+	var least *BackendInstance
+	ties := 0
+	for _, instance := range instances {
+		switch {
+		case least == nil || instance.Outstanding() < least.Outstanding():
+			least, ties = instance, 1
+		case instance.Outstanding() == least.Outstanding():
+			// Reservoir sampling among the equals
+			if ties++; b.rand.Intn(ties) == 0 {
+				least = instance
+			}
+		}
+	}
+	return least
+}
+
+type powerOfTwoChoicesBalancer struct {
+	rand *rand.Rand
+}
+
+// NewPowerOfTwoChoicesBalancer returns a Balancer picking two instances at
+// random and keeping the one with the fewest calls in flight. It spreads the
+// load nearly as well as least outstanding, without herding every gateway
+// replica onto the same idle instance.
+func NewPowerOfTwoChoicesBalancer() Balancer {
+	return &powerOfTwoChoicesBalancer{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (b *powerOfTwoChoicesBalancer) Pick(instances []*BackendInstance) *BackendInstance {
+	if len(instances) == 1 {
+		return instances[0]
+	}
+	i := b.rand.Intn(len(instances))
+	j := b.rand.Intn(len(instances) - 1)
+	if j >= i {
+		j++
+	}
+	if instances[j].Outstanding() < instances[i].Outstanding() {
+		return instances[j]
+	}
+	return instances[i]
+}
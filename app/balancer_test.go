@@ -0,0 +1,66 @@
+package addsvc
+
+import (
+	"testing"
+)
+
+func testInstances(outstanding ...int64) []*BackendInstance {
+	var instances []*BackendInstance
+	for i, n := range outstanding {
+		instances = append(instances, &BackendInstance{addr: string(rune('a' + i)), outstanding: n})
+	}
+	return instances
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	b := NewRoundRobinBalancer()
+	instances := testInstances(0, 0, 0)
+	picked := map[string]int{}
+	for i := 0; i < 30; i++ {
+		picked[b.Pick(instances).Addr()]++
+	}
+	for _, instance := range instances {
+		if have := picked[instance.Addr()]; have != 10 {
+			t.Errorf("%s: want 10 picks, have %d", instance.Addr(), have)
+		}
+	}
+}
+
+func TestLeastOutstandingBalancer(t *testing.T) {
+	b := NewLeastOutstandingBalancer()
+	instances := testInstances(3, 1, 2, 1)
+	picked := map[string]int{}
+	for i := 0; i < 100; i++ {
+		picked[b.Pick(instances).Addr()]++
+	}
+	if picked["b"] == 0 || picked["d"] == 0 || picked["b"]+picked["d"] != 100 {
+		t.Errorf("want the picks spread over b and d, have %v", picked)
+	}
+}
+
+func TestPowerOfTwoChoicesBalancer(t *testing.T) {
+	b := NewPowerOfTwoChoicesBalancer()
+	instances := testInstances(10, 0, 10)
+	picked := map[string]int{}
+	for i := 0; i < 300; i++ {
+		picked[b.Pick(instances).Addr()]++
+	}
+	// b is picked whenever it is one of the two choices, 2 times out of 3
+	if picked["b"] < 150 {
+		t.Errorf("want b picked most, have %v", picked)
+	}
+	if have := b.Pick(testInstances(5)).Addr(); have != "a" {
+		t.Errorf("want the only instance, have %s", have)
+	}
+}
+
+func TestParseBalancer(t *testing.T) {
+	for name := range Balancers {
+		if _, err := ParseBalancer(name); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := ParseBalancer("random"); err == nil {
+		t.Error("want an error for an unknown balancer")
+	}
+}
@@ -0,0 +1,216 @@
+package addsvc
+
+// This file provides bulkheads: a cap on the calls in flight to each
+// backend, so that a slow backend holds a bounded number of goroutines and
+// cannot starve the calls to the other backends.
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// BulkheadSettings configures a Bulkhead. Calls beyond MaxInFlight wait in a
+// queue of at most MaxQueue calls, for at most MaxWait.
+type BulkheadSettings struct {
+	MaxInFlight int
+	MaxQueue    int
+	MaxWait     time.Duration
+}
+
+// Bulkhead limits the calls in flight to a backend. It is safe for
+// concurrent use.
+type Bulkhead struct {
+	name     string
+	maxWait  time.Duration
+	slots    chan struct{}
+	queue    chan struct{}
+	inFlight int64
+	queued   int64
+
+	inFlightGauge metrics.Gauge
+	queuedGauge   metrics.Gauge
+	rejected      metrics.Counter
+}
+
+// NewBulkhead returns a Bulkhead for the backend name.
+func NewBulkhead(name string, settings BulkheadSettings, inFlight, queued metrics.Gauge, rejected metrics.Counter) *Bulkhead {
+	if settings.MaxInFlight < 1 {
+		settings.MaxInFlight = 1
+	}
+	return &Bulkhead{
+		name:          name,
+		maxWait:       settings.MaxWait,
+		slots:         make(chan struct{}, settings.MaxInFlight),
+		queue:         make(chan struct{}, settings.MaxQueue),
+		inFlightGauge: inFlight,
+		queuedGauge:   queued,
+		rejected:      rejected,
+	}
+}
+
+// acquire takes a slot, waiting in the queue if there is room. It returns
+// false if the call must be rejected.
+func (b *Bulkhead) acquire(ctx context.Context) bool {
+	select {
+	case b.slots <- struct{}{}:
+		b.inFlightGauge.Set(float64(atomic.AddInt64(&b.inFlight, 1)))
+		return true
+	default:
+	}
+
+	select {
+	case b.queue <- struct{}{}:
+	default:
+		return false
+	}
+	b.queuedGauge.Set(float64(atomic.AddInt64(&b.queued, 1)))
+	defer func() {
+		<-b.queue
+		b.queuedGauge.Set(float64(atomic.AddInt64(&b.queued, -1)))
+	}()
+
+	timer := time.NewTimer(b.maxWait)
+	defer timer.Stop()
+
+	select {
+	case b.slots <- struct{}{}:
+		b.inFlightGauge.Set(float64(atomic.AddInt64(&b.inFlight, 1)))
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (b *Bulkhead) release() {
+	<-b.slots
+	b.inFlightGauge.Set(float64(atomic.AddInt64(&b.inFlight, -1)))
+}
+
+// BulkheadMiddleware returns an endpoint middleware rejecting the calls
+// exceeding the bulkhead with codes.ResourceExhausted (503 over HTTP, the
+// error carrying a google.rpc.ResourceInfo detail naming the backend).
+func BulkheadMiddleware(b *Bulkhead) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			if !b.acquire(ctx) {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				b.rejected.Add(1)
+				return nil, overloadError("backend", b.name)
+			}
+			defer b.release()
+			return next(ctx, request)
+		}
+	}
+}
+
+// overloadError returns a ResourceExhausted error for a gateway resource
+// i.e. a backend, as opposed to a client exceeding its rate limit.
+func overloadError(resourceType, name string) error {
+	return rejectionError(codes.ResourceExhausted, resourceType, name, "too many calls in flight to %s %s", resourceType, name)
+}
+
+// rejectionError returns an error of the gateway turning a call down itself,
+// as opposed to forwarding it, carrying a google.rpc.ResourceInfo detail
+// naming the gateway resource.
+func rejectionError(code codes.Code, resourceType, name, format string, a ...interface{}) error {
+	s := status.New(code, fmt.Sprintf(format, a...))
+	if detailed, err := s.WithDetails(&errdetails.ResourceInfo{ResourceType: resourceType, ResourceName: name}); err == nil {
+		s = detailed
+	}
+	return s.Err()
+}
+
+// isRejection returns whether err was returned by the gateway turning a call
+// down itself i.e. by an open circuit breaker or a full bulkhead, rather than
+// by a backend.
+func isRejection(err error) bool {
+	s, ok := status.FromError(err)
+	if !ok || s == nil {
+		return false
+	}
+	for _, detail := range s.Details() {
+		if _, ok := detail.(*errdetails.ResourceInfo); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Bulkheads holds a bulkhead per backend, created on first use.
+type Bulkheads struct {
+	defaults BulkheadSettings
+	limits   map[string]int
+	inFlight metrics.Gauge
+	queued   metrics.Gauge
+	rejected metrics.Counter
+
+	mtx       sync.Mutex
+	bulkheads map[string]*Bulkhead
+}
+
+// NewBulkheads returns an empty set of bulkheads, created with defaults
+// except for the in flight limits of limits, keyed by backend. The gauges and
+// counter must be labelled by backend.
+func NewBulkheads(defaults BulkheadSettings, limits map[string]int, inFlight, queued metrics.Gauge, rejected metrics.Counter) *Bulkheads {
+	return &Bulkheads{
+		defaults:  defaults,
+		limits:    limits,
+		inFlight:  inFlight,
+		queued:    queued,
+		rejected:  rejected,
+		bulkheads: map[string]*Bulkhead{},
+	}
+}
+
+// Get returns the bulkhead of backend i.e. grpc_types.Hello.
+func (bs *Bulkheads) Get(backend string) *Bulkhead {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+
+	b, ok := bs.bulkheads[backend]
+	if !ok {
+		settings := bs.defaults
+		if limit, ok := bs.limits[backend]; ok {
+			settings.MaxInFlight = limit
+		}
+		b = NewBulkhead(backend, settings, bs.inFlight.With("backend", backend), bs.queued.With("backend", backend), bs.rejected.With("backend", backend))
+		bs.bulkheads[backend] = b
+	}
+	return b
+}
+
+// ParseBulkheadLimits parses comma separated backend=limit pairs i.e.
+// grpc_types.Hello=50,grpc_types.AgentManagement=200
+func ParseBulkheadLimits(s string) (map[string]int, error) {
+	limits := map[string]int{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid bulkhead limit %q, want backend=limit", pair)
+		}
+		limit, err := strconv.Atoi(pair[i+1:])
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("invalid bulkhead limit %q, want backend=limit", pair)
+		}
+		limits[pair[:i]] = limit
+	}
+	return limits, nil
+}
@@ -0,0 +1,82 @@
+package addsvc
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/discard"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestBulkheadMiddleware(t *testing.T) {
+	b := NewBulkhead("grpc_types.Hello", BulkheadSettings{MaxInFlight: 1, MaxQueue: 1, MaxWait: 50 * time.Millisecond}, discard.NewGauge(), discard.NewGauge(), discard.NewCounter())
+
+	release := make(chan struct{})
+	e := BulkheadMiddleware(b)(func(ctx context.Context, _ interface{}) (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+
+	// The first call holds the only slot
+	done := make(chan error, 2)
+	go func() {
+		_, err := e(context.Background(), nil)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// The second waits in the queue, and gets the slot once released
+	go func() {
+		_, err := e(context.Background(), nil)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// The queue is full
+	_, err := e(context.Background(), nil)
+	if grpc.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("want ResourceExhausted, have %v", err)
+	}
+	rec := httptest.NewRecorder()
+	errorEncoder(context.Background(), err, rec)
+	if rec.Code != 503 {
+		t.Errorf("want 503, have %d", rec.Code)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("call %d: %v", i, err)
+		}
+	}
+}
+
+func TestBulkheadQueueTimeout(t *testing.T) {
+	b := NewBulkhead("grpc_types.Hello", BulkheadSettings{MaxInFlight: 1, MaxQueue: 1, MaxWait: 10 * time.Millisecond}, discard.NewGauge(), discard.NewGauge(), discard.NewCounter())
+	if !b.acquire(context.Background()) {
+		t.Fatal("want a free slot")
+	}
+	if b.acquire(context.Background()) {
+		t.Fatal("want the queued call to time out")
+	}
+	b.release()
+	if !b.acquire(context.Background()) {
+		t.Fatal("want the released slot")
+	}
+}
+
+func TestParseBulkheadLimits(t *testing.T) {
+	limits, err := ParseBulkheadLimits("grpc_types.Hello=50, grpc_types.AgentManagement=200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits["grpc_types.Hello"] != 50 || limits["grpc_types.AgentManagement"] != 200 {
+		t.Errorf("unexpected limits %v", limits)
+	}
+	if _, err := ParseBulkheadLimits("grpc_types.Hello"); err == nil {
+		t.Error("want an error for a missing limit")
+	}
+}
@@ -0,0 +1,320 @@
+package addsvc
+
+// This file provides a circuit breaker per backend service. Once a backend
+// fails too often, calls to it are rejected straight away for a while instead
+// of waiting on it, then a few probe calls decide whether it has recovered.
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"google.golang.org/grpc/codes"
+)
+
+// BreakerState is the state of a CircuitBreaker.
+type BreakerState int
+
+// The states are ordered by severity, their values are exported as the
+// breaker state gauge.
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	}
+	return "unknown"
+}
+
+// BreakerSettings configures when a CircuitBreaker opens and closes.
+type BreakerSettings struct {
+	// ConsecutiveFailures opens the breaker after that many failures in a
+	// row, zero disables it.
+	ConsecutiveFailures int
+	// ErrorRatio opens the breaker when the ratio of failed calls within an
+	// Interval reaches it, once there were at least MinRequests calls. Zero
+	// disables it.
+	ErrorRatio  float64
+	MinRequests int
+	Interval    time.Duration
+	// OpenTimeout is how long the breaker stays open before letting
+	// HalfOpenRequests probe calls through.
+	OpenTimeout      time.Duration
+	HalfOpenRequests int
+}
+
+// DefaultBreakerSettings are sensible settings for the linkerd backends.
+var DefaultBreakerSettings = BreakerSettings{
+	ConsecutiveFailures: 5,
+	ErrorRatio:          0.5,
+	MinRequests:         20,
+	Interval:            10 * time.Second,
+	OpenTimeout:         30 * time.Second,
+	HalfOpenRequests:    1,
+}
+
+// CircuitBreaker tracks the failures of the calls to a backend. It is safe
+// for concurrent use.
+type CircuitBreaker struct {
+	name     string
+	settings BreakerSettings
+	gauge    metrics.Gauge
+	logger   log.Logger
+	now      func() time.Time
+
+	mtx         sync.Mutex
+	state       BreakerState
+	generation  uint64
+	expiry      time.Time // end of the closed interval or of the open timeout
+	requests    int
+	failures    int
+	successes   int
+	consecutive int
+	probes      int
+}
+
+// NewCircuitBreaker returns a closed breaker for the backend name. Its state
+// is exported to gauge and its transitions logged.
+func NewCircuitBreaker(name string, settings BreakerSettings, gauge metrics.Gauge, logger log.Logger) *CircuitBreaker {
+	if settings.HalfOpenRequests < 1 {
+		settings.HalfOpenRequests = 1
+	}
+	b := &CircuitBreaker{
+		name:     name,
+		settings: settings,
+		gauge:    gauge,
+		logger:   log.With(logger, "breaker", name),
+		now:      time.Now,
+	}
+	b.setState(BreakerClosed, b.now())
+	return b
+}
+
+// Name returns the name of the backend.
+func (b *CircuitBreaker) Name() string {
+	return b.name
+}
+
+// State returns the current state of the breaker.
+func (b *CircuitBreaker) State() BreakerState {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.update(b.now())
+	return b.state
+}
+
+// allow reports whether a call may go through. If so, the call must report
+// its outcome with done and the returned generation.
+func (b *CircuitBreaker) allow() (uint64, bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.update(b.now())
+	switch b.state {
+	case BreakerOpen:
+		return 0, false
+	case BreakerHalfOpen:
+		if b.probes >= b.settings.HalfOpenRequests {
+			return 0, false
+		}
+		b.probes++
+	}
+	b.requests++
+	return b.generation, true
+}
+
+// done records the outcome of a call made with ctx. Errors count as
+// failures, except for the faults of the caller, cancellations and its own
+// deadline being exceeded, which are not counted at all. Outcomes of calls
+// started before the last state change are ignored.
+func (b *CircuitBreaker) done(ctx context.Context, generation uint64, err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := b.now()
+	b.update(now)
+	if generation != b.generation {
+		return
+	}
+
+	if callerFault(ctx, err) {
+		b.requests--
+		if b.state == BreakerHalfOpen {
+			b.probes--
+		}
+		return
+	}
+
+	if err == nil {
+		b.successes++
+		b.consecutive = 0
+		if b.state == BreakerHalfOpen && b.successes >= b.settings.HalfOpenRequests {
+			b.setState(BreakerClosed, now)
+		}
+		return
+	}
+
+	b.failures++
+	b.consecutive++
+	if b.state == BreakerHalfOpen || b.tripped() {
+		b.setState(BreakerOpen, now)
+	}
+}
+
+func (b *CircuitBreaker) tripped() bool {
+	s := b.settings
+	if s.ConsecutiveFailures > 0 && b.consecutive >= s.ConsecutiveFailures {
+		return true
+	}
+	return s.ErrorRatio > 0 && b.requests >= s.MinRequests && float64(b.failures)/float64(b.requests) >= s.ErrorRatio
+}
+
+// update moves to the next interval when the current one has expired.
+func (b *CircuitBreaker) update(now time.Time) {
+	if b.expiry.IsZero() || now.Before(b.expiry) {
+		return
+	}
+	switch b.state {
+	case BreakerClosed:
+		b.newGeneration(now)
+	case BreakerOpen:
+		b.setState(BreakerHalfOpen, now)
+	}
+}
+
+func (b *CircuitBreaker) setState(state BreakerState, now time.Time) {
+	if state != b.state {
+		b.logger.Log("level", "warn", "msg", "circuit breaker state changed", "from", b.state, "to", state)
+	}
+	b.state = state
+	b.gauge.Set(float64(state))
+	b.newGeneration(now)
+}
+
+func (b *CircuitBreaker) newGeneration(now time.Time) {
+	b.generation++
+	b.requests, b.failures, b.successes, b.consecutive, b.probes = 0, 0, 0, 0, 0
+
+	b.expiry = time.Time{}
+	switch b.state {
+	case BreakerClosed:
+		if b.settings.Interval > 0 {
+			b.expiry = now.Add(b.settings.Interval)
+		}
+	case BreakerOpen:
+		b.expiry = now.Add(b.settings.OpenTimeout)
+	}
+}
+
+// CircuitBreakerMiddleware returns an endpoint middleware rejecting calls
+// with codes.Unavailable (503 over HTTP) while breaker is open. Business
+// errors bundled in the response do not count as failures.
+func CircuitBreakerMiddleware(breaker *CircuitBreaker) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			generation, ok := breaker.allow()
+			if !ok {
+				return nil, rejectionError(codes.Unavailable, "circuit_breaker", breaker.name, "circuit breaker for %s is open", breaker.name)
+			}
+
+			response, err = next(ctx, request)
+			breaker.done(ctx, generation, err)
+			return response, err
+		}
+	}
+}
+
+// CircuitBreakers holds a breaker per backend, created on first use with
+// the same settings. Their state is exported to a gauge labelled by backend.
+type CircuitBreakers struct {
+	settings BreakerSettings
+	gauge    metrics.Gauge
+	logger   log.Logger
+
+	mtx      sync.Mutex
+	breakers map[string]*CircuitBreaker
+}
+
+// NewCircuitBreakers returns an empty set of breakers.
+func NewCircuitBreakers(settings BreakerSettings, gauge metrics.Gauge, logger log.Logger) *CircuitBreakers {
+	return &CircuitBreakers{
+		settings: settings,
+		gauge:    gauge,
+		logger:   logger,
+		breakers: map[string]*CircuitBreaker{},
+	}
+}
+
+// Get returns the breaker of backend i.e. grpc_types.Hello.
+func (c *CircuitBreakers) Get(backend string) *CircuitBreaker {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	b, ok := c.breakers[backend]
+	if !ok {
+		b = NewCircuitBreaker(backend, c.settings, c.gauge.With("backend", backend), c.logger)
+		c.breakers[backend] = b
+	}
+	return b
+}
+
+// breakerInfo is the debug representation of a CircuitBreaker.
+type breakerInfo struct {
+	Name                string     `json:"name"`
+	State               string     `json:"state"`
+	Requests            int        `json:"requests"`
+	Failures            int        `json:"failures"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Until               *time.Time `json:"until,omitempty"`
+}
+
+// MakeCircuitBreakerDebugHandler returns a handler serving the state of the
+// breakers as JSON.
+func MakeCircuitBreakerDebugHandler(breakers *CircuitBreakers) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		breakers.mtx.Lock()
+		infos := make([]breakerInfo, 0, len(breakers.breakers))
+		for _, b := range breakers.breakers {
+			infos = append(infos, b.info())
+		}
+		breakers.mtx.Unlock()
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(infos)
+	})
+}
+
+func (b *CircuitBreaker) info() breakerInfo {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.update(b.now())
+	info := breakerInfo{
+		Name:                b.name,
+		State:               b.state.String(),
+		Requests:            b.requests,
+		Failures:            b.failures,
+		ConsecutiveFailures: b.consecutive,
+	}
+	if b.state == BreakerOpen {
+		until := b.expiry
+		info.Until = &until
+	}
+	return info
+}
@@ -0,0 +1,127 @@
+package addsvc
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/discard"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	breakers := NewCircuitBreakers(BreakerSettings{
+		ConsecutiveFailures: 2,
+		OpenTimeout:         time.Second,
+	}, discard.NewGauge(), log.NewNopLogger())
+	b := breakers.Get("grpc_types.Hello")
+	b.now = func() time.Time { return now }
+
+	var backendErr error
+	calls := 0
+	e := CircuitBreakerMiddleware(b)(func(context.Context, interface{}) (interface{}, error) {
+		calls++
+		return nil, backendErr
+	})
+
+	backendErr = errors.New("unavailable")
+	e(context.Background(), nil)
+	if b.State() != BreakerClosed {
+		t.Fatal("want the breaker closed after a single failure")
+	}
+	e(context.Background(), nil)
+	if b.State() != BreakerOpen {
+		t.Fatal("want the breaker open after two consecutive failures")
+	}
+
+	if _, err := e(context.Background(), nil); grpc.Code(err) != codes.Unavailable || calls != 2 {
+		t.Errorf("want calls rejected with Unavailable while open, have %v after %d calls", err, calls)
+	}
+
+	rec := httptest.NewRecorder()
+	MakeCircuitBreakerDebugHandler(breakers).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/breakers", nil))
+	if !strings.Contains(rec.Body.String(), `"state":"open"`) {
+		t.Errorf("want the open breaker in the debug output, have %s", rec.Body.String())
+	}
+
+	// A failed probe opens the breaker again
+	now = now.Add(time.Second)
+	if b.State() != BreakerHalfOpen {
+		t.Fatal("want the breaker half-open after the timeout")
+	}
+	e(context.Background(), nil)
+	if b.State() != BreakerOpen {
+		t.Fatal("want the breaker open after a failed probe")
+	}
+
+	// A successful probe closes it
+	now = now.Add(time.Second)
+	backendErr = nil
+	if _, err := e(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if b.State() != BreakerClosed {
+		t.Fatal("want the breaker closed after a successful probe")
+	}
+}
+
+func TestCircuitBreakerErrorRatio(t *testing.T) {
+	b := NewCircuitBreaker("grpc_types.World", BreakerSettings{
+		ErrorRatio:  0.5,
+		MinRequests: 4,
+		Interval:    time.Minute,
+		OpenTimeout: time.Minute,
+	}, discard.NewGauge(), log.NewNopLogger())
+
+	for i, err := range []error{nil, errors.New("failed"), nil, context.Canceled, errors.New("failed")} {
+		generation, ok := b.allow()
+		if !ok {
+			t.Fatalf("call %d rejected", i)
+		}
+		b.done(context.Background(), generation, err)
+	}
+	if b.State() != BreakerOpen {
+		t.Error("want the breaker open once half of the calls failed, not counting cancellations")
+	}
+}
+
+func TestCircuitBreakerCallerDeadline(t *testing.T) {
+	b := NewCircuitBreaker("grpc_types.Hello", BreakerSettings{
+		ConsecutiveFailures: 2,
+		OpenTimeout:         time.Minute,
+	}, discard.NewGauge(), log.NewNopLogger())
+	e := DeadlineMiddleware(Timeouts{Default: duration(time.Second)})(CircuitBreakerMiddleware(b)(func(ctx context.Context, _ interface{}) (interface{}, error) {
+		<-ctx.Done()
+		return nil, status.Error(codes.DeadlineExceeded, "context deadline exceeded")
+	}))
+
+	// Callers with tiny deadlines do not open the breaker for everyone
+	for i := 0; i < 5; i++ {
+		ctx := context.WithValue(context.Background(), requestTimeoutContextKey{}, requestTimeout{value: "1ms", parse: parseRequestTimeout})
+		if _, err := e(ctx, nil); grpc.Code(err) != codes.DeadlineExceeded {
+			t.Fatalf("want DeadlineExceeded, have %v", err)
+		}
+	}
+	if b.State() != BreakerClosed {
+		t.Fatal("want the breaker closed after calls exceeding the deadline of the caller")
+	}
+
+	// The gateway timeout being exceeded blames the backend
+	e = DeadlineMiddleware(Timeouts{Default: duration(time.Millisecond)})(CircuitBreakerMiddleware(b)(func(ctx context.Context, _ interface{}) (interface{}, error) {
+		<-ctx.Done()
+		return nil, status.Error(codes.DeadlineExceeded, "context deadline exceeded")
+	}))
+	for i := 0; i < 2; i++ {
+		e(context.Background(), nil)
+	}
+	if b.State() != BreakerOpen {
+		t.Error("want the breaker open after calls exceeding the gateway timeout")
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	//"context"
+	"context"
 	"flag"
 	"fmt"
 	stdlog "log"
@@ -10,6 +10,8 @@ import (
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -22,6 +24,7 @@ import (
 	stdprometheus "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"sourcegraph.com/sourcegraph/appdash"
 	appdashot "sourcegraph.com/sourcegraph/appdash/opentracing"
 
@@ -69,10 +72,69 @@ func main() {
 		debugAddr = flag.String("debug.addr", ":9090", "Debug and metrics listen address")
 		localConn = flag.Bool("conn.local", false, "Override linkerd connection")
 
-		//httpAddr  = flag.String("http.addr", ":8081", "HTTP listen address")
-		//grpcAddr  = flag.String("grpc.addr", ":8042", "gRPC (HTTP) listen address")
+		discoveryMode           = flag.String("discovery.mode", "linkerd", "How backend instances are discovered: linkerd (every backend through linkerd), static, dns or file")
+		discoveryStatic         = flag.String("discovery.static", "", "Comma separated service=address instances for -discovery.mode static, repeated for each instance i.e. grpc_types.Hello=127.0.0.1:50051,*=127.0.0.1:4141")
+		discoveryDNS            = flag.String("discovery.dns", "_grpc._tcp.{service}", "DNS SRV name of the backends for -discovery.mode dns, {service} being the service as a DNS label i.e. grpc-types-hello")
+		discoveryFile           = flag.String("discovery.file", "", "TOML file with the instances of each backend for -discovery.mode file, reloaded on change")
+		backendConns            = flag.Int("backend.conns", addsvc.DefaultBackendSettings.Conns, "Connections to each backend instance")
+		backendKeepalive        = flag.Duration("backend.keepalive", 0, "Idle time after which a backend connection is pinged (0 to disable keepalive)")
+		backendKeepaliveTimeout = flag.Duration("backend.keepalive.timeout", addsvc.DefaultBackendSettings.KeepaliveTimeout, "Time a keepalive ping may take before the backend connection is closed")
+		backendMaxMessageSize   = flag.Int("backend.max.message.size", 0, "Maximum size in bytes of the messages sent to and received from the backends (0 for the gRPC default of 4MB received)")
+		backendBackoff          = flag.Duration("backend.backoff", addsvc.DefaultBackendSettings.BackoffMaxDelay, "Maximum delay between the attempts to reconnect to a backend instance")
 
-		debugAnyGRPCService = flag.Bool("debug.grpc.any", true, "true to enable access to any grpc service (NEVER SET TO TRUE USE IN PRODUCTION)")
+		lbPolicy        = flag.String("lb.policy", "round_robin", "How calls are spread over the instances of a backend: round_robin, least_outstanding or p2c (power of two choices)")
+		lbEjectFailures = flag.Int("lb.eject.failures", addsvc.DefaultBackendSettings.ConsecutiveFailures, "Consecutive failures ejecting a backend instance (0 to disable)")
+		lbEjectTime     = flag.Duration("lb.eject.time", addsvc.DefaultBackendSettings.EjectionTime, "Time a failing backend instance stays ejected")
+		lbEjectMax      = flag.Float64("lb.eject.max", addsvc.DefaultBackendSettings.MaxEjectedRatio, "Maximum ratio of the instances of a backend ejected at once")
+
+		discoveryRefresh = flag.Duration("discovery.refresh", 30*time.Second, "How often DNS records are resolved or the discovery file is checked")
+
+		healthInterval = flag.Duration("health.interval", 5*time.Second, "How often the readiness of the dependencies is checked")
+		healthTimeout  = flag.Duration("health.timeout", 2*time.Second, "Time a readiness check may take")
+		healthProbe    = flag.Bool("health.probe", false, "Actively probe the agent management service with Ping when checking readiness")
+
+		httpAddr = flag.String("http.addr", ":8081", "HTTP listen address")
+		grpcAddr = flag.String("grpc.addr", ":8042", "gRPC (HTTP) listen address")
+
+		jwksFile = flag.String("auth.jwks", "", "JWKS file with the HS256/RS256 keys used to validate bearer tokens (authentication is disabled if empty)")
+
+		apiKeysFile = flag.String("auth.apikeys", "", "TOML file with the SHA-256 hashes and metadata of the accepted API keys, reloaded on change (API key authentication is disabled if empty)")
+		policyFile  = flag.String("auth.policy", "", "TOML authorization policy mapping methods to the roles or scopes allowed to call them (authorization is disabled if empty)")
+
+		rateLimitFile = flag.String("ratelimit.file", "", "TOML file with the global, per client and per method rate limits (rate limiting is disabled if empty)")
+		quotaFile     = flag.String("quota.file", "", "TOML file with the cluster-wide request quotas per tenant (quotas are disabled if empty)")
+		quotaRedis    = flag.String("quota.redis", "", "Redis address the quota counters are shared through (the counters are local to this replica if empty)")
+
+		timeoutsFile = flag.String("timeouts.file", "", "TOML file with the default and maximum timeout of each method (10s and 1m for every method if empty)")
+
+		retryFile = flag.String("retry.file", "", "TOML file with the retry policy of each method (Ping, SayHello and GetAvailableAgents are retried on Unavailable if empty)")
+
+		hedgeMethods  = flag.String("hedge.methods", "", "Comma separated idempotent methods to hedge (i.e. GetAvailableAgents, hedging is disabled if empty)")
+		hedgeDelay    = flag.Duration("hedge.delay", 0, "Delay before hedging a call (0 to hedge after the hedge.quantile latency of the method)")
+		hedgeQuantile = flag.Float64("hedge.quantile", 0.95, "Latency quantile of a method after which its calls are hedged")
+
+		bulkheadMax    = flag.Int("bulkhead.max", 100, "Maximum calls in flight to each backend")
+		bulkheadLimits = flag.String("bulkhead.limits", "", "Comma separated backend=max overrides of bulkhead.max i.e. grpc_types.AgentManagement=200")
+		bulkheadQueue  = flag.Int("bulkhead.queue", 0, "Maximum calls waiting for a backend once bulkhead.max calls are in flight")
+		bulkheadWait   = flag.Duration("bulkhead.wait", 100*time.Millisecond, "Maximum time a call waits in the bulkhead queue")
+
+		adaptiveLimit   = flag.Bool("adaptive.limit", false, "true to limit the calls in flight to each method to a limit adapted to its latency")
+		adaptiveInitial = flag.Int("adaptive.initial", addsvc.DefaultAdaptiveLimitSettings.InitialLimit, "Initial adaptive limit of each method")
+		adaptiveMin     = flag.Int("adaptive.min", addsvc.DefaultAdaptiveLimitSettings.MinLimit, "Minimum adaptive limit of each method")
+		adaptiveMax     = flag.Int("adaptive.max", addsvc.DefaultAdaptiveLimitSettings.MaxLimit, "Maximum adaptive limit of each method")
+
+		shedFile  = flag.String("shed.file", "", "TOML file with the load shedding priority of each method (HeartBeat and AcceptCall are critical, SayHello and SayWorld sheddable if empty)")
+		shedMax   = flag.Int("shed.max", 0, "Maximum calls in flight through the gateway before shedding the lowest priority ones (load shedding is disabled if 0)")
+		shedQueue = flag.Int("shed.queue", 100, "Maximum calls waiting once shed.max calls are in flight")
+		shedWait  = flag.Duration("shed.wait", 200*time.Millisecond, "Maximum time a call waits in the load shedding queue")
+
+		breakerFailures = flag.Int("breaker.failures", addsvc.DefaultBreakerSettings.ConsecutiveFailures, "Consecutive backend failures opening its circuit breaker (0 to disable)")
+		breakerRatio    = flag.Float64("breaker.ratio", addsvc.DefaultBreakerSettings.ErrorRatio, "Ratio of failed backend calls opening its circuit breaker (0 to disable)")
+		breakerTimeout  = flag.Duration("breaker.timeout", addsvc.DefaultBreakerSettings.OpenTimeout, "Time an open circuit breaker waits before probing its backend again")
+
+		routesFile = flag.String("routes.file", "", "TOML route table mapping extra HTTP routes to backend gRPC methods")
+
+		debugAnyGRPCService = flag.Bool("debug.grpc.any", false, "true to enable access to any grpc service (NEVER SET TO TRUE USE IN PRODUCTION)")
 		//thriftAddr       = flag.String("thrift.addr", ":8083", "Thrift listen address")
 		//thriftProtocol   = flag.String("thrift.protocol", "binary", "binary, compact, json, simplejson")
 		//thriftBufferSize = flag.Int("thrift.buffer.size", 0, "0 for unbuffered")
@@ -86,11 +148,9 @@ func main() {
 		//linkerdAddr = flag.String("linkerd.addr", ":4041", "Linkerd ingress address")
 
 		// Debug only (Should NEVER be used in production)
-		httpAnyServiceAddr = flag.String("debug.httpanyservice.addr", ":9001", "HTTP listen address for accessing any service")
-		gRPCAnyServiceAddr = flag.String("debug.grpcanyservice.addr", ":9002", "gRPC (HTTP) listen address for accessing any service")
-
-		// other
-		l5dConn *grpc.ClientConn
+		httpAnyServiceAddr  = flag.String("debug.httpanyservice.addr", ":9001", "HTTP listen address for accessing any service")
+		gRPCAnyServiceAddr  = flag.String("debug.grpcanyservice.addr", ":9002", "gRPC (HTTP) listen address for accessing any service")
+		gRPCAnyServiceAllow = flag.String("debug.grpcanyservice.allow", "", "Comma separated gRPC services (i.e. grpc_types.Hello, or * for all) proxied to the backends by the any service gRPC listener")
 	)
 	flag.Parse()
 
@@ -156,6 +216,102 @@ func main() {
 			Help:      "Request duration in nanoseconds.",
 		}, []string{"method", "success"})
 	}
+	// latencies keeps the recent latencies observed in duration, for the
+	// middlewares adapting to them.
+	latencies := addsvc.NewLatencyTracker(duration, 1000)
+	duration = latencies
+	var hedges metrics.Counter
+	{
+		hedges = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "addsvc",
+			Name:      "hedged_requests_total",
+			Help:      "Total count of hedged calls, by winning call.",
+		}, []string{"method", "winner"})
+	}
+	var throttled metrics.Counter
+	{
+		throttled = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "addsvc",
+			Name:      "ratelimit_throttled_requests_total",
+			Help:      "Total count of requests rejected by the rate limiter.",
+		}, []string{"method", "scope"})
+	}
+	var retries metrics.Counter
+	{
+		retries = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "addsvc",
+			Name:      "retries_total",
+			Help:      "Total count of backend calls retried.",
+		}, []string{"method"})
+	}
+	var bulkheadInFlight, bulkheadQueued metrics.Gauge
+	var bulkheadRejected metrics.Counter
+	{
+		bulkheadInFlight = prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "addsvc",
+			Name:      "bulkhead_in_flight",
+			Help:      "Calls in flight to each backend.",
+		}, []string{"backend"})
+		bulkheadQueued = prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "addsvc",
+			Name:      "bulkhead_queued",
+			Help:      "Calls waiting for each backend.",
+		}, []string{"backend"})
+		bulkheadRejected = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "addsvc",
+			Name:      "bulkhead_rejected_total",
+			Help:      "Total count of calls rejected by the bulkhead of each backend.",
+		}, []string{"backend"})
+	}
+	var adaptiveLimits metrics.Gauge
+	var adaptiveRejected metrics.Counter
+	{
+		adaptiveLimits = prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "addsvc",
+			Name:      "adaptive_concurrency_limit",
+			Help:      "Current adaptive limit of the calls in flight to each method.",
+		}, []string{"method"})
+		adaptiveRejected = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "addsvc",
+			Name:      "adaptive_rejected_total",
+			Help:      "Total count of calls rejected by the adaptive limit of each method.",
+		}, []string{"method"})
+	}
+	var shedInFlight, shedQueued metrics.Gauge
+	var shedCalls metrics.Counter
+	{
+		shedInFlight = prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "addsvc",
+			Name:      "shedding_in_flight",
+			Help:      "Calls in flight through the gateway.",
+		}, []string{})
+		shedQueued = prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "addsvc",
+			Name:      "shedding_queued",
+			Help:      "Calls waiting in the load shedding queue.",
+		}, []string{})
+		shedCalls = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "addsvc",
+			Name:      "shed_requests_total",
+			Help:      "Total count of calls shed by priority.",
+		}, []string{"priority", "reason"})
+	}
+	var backendEjections metrics.Counter
+	{
+		backendEjections = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "addsvc",
+			Name:      "backend_ejections_total",
+			Help:      "Total count of backend instances ejected after repeated failures.",
+		}, []string{"backend"})
+	}
+	var breakerState metrics.Gauge
+	{
+		breakerState = prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "addsvc",
+			Name:      "circuit_breaker_state",
+			Help:      "State of the backend circuit breakers: 0 closed, 1 half-open, 2 open.",
+		}, []string{"backend"})
+	}
 
 	// Tracing domain.
 	var tracer stdopentracing.Tracer
@@ -238,39 +394,542 @@ func main() {
 		l5dHost = defaultLinkerdHost
 	}
 
-	// Connect to local linkerd
+	// Discover the backend instances, all of them being reached through
+	// linkerd by default
+	discoveryLogger := log.With(logger, "tag", "#discovery")
+
+	var discovery addsvc.Discovery
+	switch *discoveryMode {
+	case "linkerd":
+		discovery = addsvc.StaticDiscovery{"*": {l5dHost}}
+	case "static":
+		d, err := addsvc.ParseStaticDiscovery(*discoveryStatic)
+		if err != nil {
+			logger.Log("msg", "Invalid static backend instances", "err", err, "level", "crit")
+			os.Exit(1)
+		}
+		discovery = d
+	case "dns":
+		d := addsvc.NewDNSSRVDiscovery(*discoveryDNS, *discoveryRefresh, discoveryLogger)
+		defer d.Stop()
+		discovery = d
+	case "file":
+		d, err := addsvc.NewFileDiscovery(*discoveryFile)
+		if err != nil {
+			logger.Log("msg", "Failed to load the backend instances", "err", err, "level", "crit")
+			os.Exit(1)
+		}
+		go d.Watch(context.Background(), *discoveryRefresh, discoveryLogger)
+		discovery = d
+	default:
+		logger.Log("msg", "Unknown discovery mode", "mode", *discoveryMode, "level", "crit")
+		os.Exit(1)
+	}
+	discoveryLogger.Log("mode", *discoveryMode, "level", "info", "msg", "Discovering the backend instances")
 
-	// Linkerd logger
-	l5dLogger := log.With(logger, "connection", "linkerd")
+	// Connections to each backend instance, the calls being balanced over
+	// them. The backends only connect on first use.
+	newBalancer, err := addsvc.ParseBalancer(*lbPolicy)
+	if err != nil {
+		logger.Log("msg", "Invalid load balancing policy", "err", err, "level", "crit")
+		os.Exit(1)
+	}
+	backendSettings := addsvc.BackendSettings{
+		Conns:               *backendConns,
+		KeepaliveTime:       *backendKeepalive,
+		KeepaliveTimeout:    *backendKeepaliveTimeout,
+		MaxMessageSize:      *backendMaxMessageSize,
+		BackoffMaxDelay:     *backendBackoff,
+		Balancer:            newBalancer,
+		ConsecutiveFailures: *lbEjectFailures,
+		EjectionTime:        *lbEjectTime,
+		MaxEjectedRatio:     *lbEjectMax,
+	}
+	backendLogger := log.With(logger, "tag", "#backend")
+	backends := addsvc.NewBackends(discovery, backendSettings, backendEjections, backendLogger, grpc.WithInsecure())
+	proxyBackends := addsvc.NewBackends(discovery, backendSettings, backendEjections, backendLogger, grpc.WithInsecure(), grpc.WithCodec(addsvc.ProxyCodec()))
 
-	// If address is incorrect retries forever at the moment
-	// https://github.com/grpc/grpc-go/issues/133
-	var errL5d error
-	l5dConn, errL5d = grpc.Dial(l5dHost, grpc.WithInsecure(), grpc.WithTimeout(time.Second))
-	if errL5d != nil {
-		l5dLogger.Log("msg", "Failed to connect to local linkerd", "level", "crit")
-		errc <- errL5d
-		return
+	backend := func(service string) *addsvc.Backend {
+		b, err := backends.Get(service)
+		if err != nil {
+			logger.Log("msg", "Failed to connect to the backend", "service", service, "err", err, "level", "crit")
+			os.Exit(1)
+		}
+		return b
 	}
-	defer l5dConn.Close()
+	helloBackend := backend("grpc_types.Hello")
+	worldBackend := backend("grpc_types.World")
+	agentBackend := backend("grpc_types.AgentManagement")
 
-	l5dLogger.Log("host", l5dHost, "msg", "successfully connected")
+	// The backends are dialed without blocking, the gateway serving (and
+	// failing the calls to the backends down) while they connect
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		var waiting string
+		for err := backends.Ready(); err != nil; err = backends.Ready() {
+			if err.Error() != waiting {
+				waiting = err.Error()
+				backendLogger.Log("msg", "Waiting for the backends to connect", "err", err, "level", "warn")
+			}
+			<-ticker.C
+		}
+		backendLogger.Log("msg", "Connected to the backends", "level", "info")
+	}()
+
+	// Readiness of the dependencies, served at /readyz and by the gRPC
+	// Health service
+	health := addsvc.NewHealth(*healthTimeout, log.With(logger, "tag", "#health"))
+	for service, b := range map[string]*addsvc.Backend{
+		"grpc_types.Hello":           helloBackend,
+		"grpc_types.World":           worldBackend,
+		"grpc_types.AgentManagement": agentBackend,
+	} {
+		health.Add(service, addsvc.BackendHealthCheck(b))
+	}
+	if *healthProbe {
+		health.Add("grpc_types.AgentManagement/Ping", addsvc.PingHealthCheck(addsvc.BackendEndpoint(agentBackend, addsvc.MakePingEndpoint)))
+	}
+	go health.Run(context.Background(), *healthInterval)
 
 	// ---------------------------------------------------------------------------
 
+	// Authentication domain.
+	authentication := endpoint.Middleware(func(next endpoint.Endpoint) endpoint.Endpoint { return next })
+	if *jwksFile != "" {
+		keys, err := addsvc.LoadJWKS(*jwksFile)
+		if err != nil {
+			logger.Log("msg", "Failed to load the JWT signing keys", "err", err, "level", "crit")
+			os.Exit(1)
+		}
+		authentication = addsvc.JWTAuthMiddleware(keys)
+		logger.Log("msg", "JWT authentication enabled", "jwks", *jwksFile, "level", "info")
+	}
+	if *apiKeysFile != "" {
+		keyStore, err := addsvc.NewFileKeyStore(*apiKeysFile)
+		if err != nil {
+			logger.Log("msg", "Failed to load the API keys", "err", err, "level", "crit")
+			os.Exit(1)
+		}
+		go keyStore.Watch(context.Background(), 10*time.Second, log.With(logger, "tag", "#apikeys"))
+
+		if *jwksFile != "" {
+			authentication = addsvc.APIKeyOrBearerMiddleware(addsvc.APIKeyAuthMiddleware(keyStore), authentication)
+		} else {
+			authentication = addsvc.APIKeyAuthMiddleware(keyStore)
+		}
+		logger.Log("msg", "API key authentication enabled", "keys", *apiKeysFile, "level", "info")
+	}
+
+	// authenticate returns the authentication middleware of a method,
+	// letting anonymous callers through to the methods the policy allows to
+	// all.
+	authenticate := func(method string) endpoint.Middleware {
+		return authentication
+	}
+
+	// authorize returns the authorization middleware of a method. It must be
+	// applied before authenticate, which provides the claims or API key.
+	authorize := func(method string) endpoint.Middleware {
+		return func(next endpoint.Endpoint) endpoint.Endpoint { return next }
+	}
+	if *apiKeysFile != "" && *policyFile == "" {
+		// Without a policy every JWT is allowed, but API keys are still
+		// restricted to their routes.
+		policy := &addsvc.Policy{Default: addsvc.Rule{AllowAll: true}}
+		authorize = func(method string) endpoint.Middleware {
+			return addsvc.AuthorizationMiddleware(policy, method, logger)
+		}
+	}
+	if *policyFile != "" {
+		if *jwksFile == "" && *apiKeysFile == "" {
+			logger.Log("msg", "An authorization policy requires authentication, set -auth.jwks or -auth.apikeys", "level", "crit")
+			os.Exit(1)
+		}
+		policy, err := addsvc.LoadPolicy(*policyFile)
+		if err != nil {
+			logger.Log("msg", "Failed to load the authorization policy", "err", err, "level", "crit")
+			os.Exit(1)
+		}
+		authorize = func(method string) endpoint.Middleware {
+			return addsvc.AuthorizationMiddleware(policy, method, logger)
+		}
+		authenticate = func(method string) endpoint.Middleware {
+			return policy.Authenticate(method, authentication)
+		}
+		logger.Log("msg", "Authorization policy enabled", "policy", *policyFile, "level", "info")
+	}
+
+	// Rate limiting domain. rateLimit must be applied before authenticate,
+	// which identifies the clients.
+	rateLimit := func(method string) endpoint.Middleware {
+		return func(next endpoint.Endpoint) endpoint.Endpoint { return next }
+	}
+	if *rateLimitFile != "" {
+		config, err := addsvc.LoadRateLimitConfig(*rateLimitFile)
+		if err != nil {
+			logger.Log("msg", "Failed to load the rate limits", "err", err, "level", "crit")
+			os.Exit(1)
+		}
+		limiter := addsvc.NewRateLimiter(config)
+		rateLimit = func(method string) endpoint.Middleware {
+			return addsvc.RateLimitingMiddleware(limiter, method, throttled.With("method", method))
+		}
+		logger.Log("msg", "Rate limiting enabled", "limits", *rateLimitFile, "level", "info")
+	}
+
+	// quota must be applied before authenticate, which identifies the tenants.
+	quota := func(method string) endpoint.Middleware {
+		return func(next endpoint.Endpoint) endpoint.Endpoint { return next }
+	}
+	if *quotaFile != "" {
+		config, err := addsvc.LoadQuotaConfig(*quotaFile)
+		if err != nil {
+			logger.Log("msg", "Failed to load the quotas", "err", err, "level", "crit")
+			os.Exit(1)
+		}
+
+		var store addsvc.RateLimitStore = addsvc.NewMemoryRateLimitStore()
+		if *quotaRedis != "" {
+			store = addsvc.NewRedisRateLimitStore(*quotaRedis, 16, 100*time.Millisecond)
+		}
+
+		limiter := addsvc.NewQuotaLimiter(config, store)
+		quotaLogger := log.With(logger, "tag", "#quota")
+		quota = func(method string) endpoint.Middleware {
+			return addsvc.QuotaMiddleware(limiter, method, throttled.With("method", method), quotaLogger)
+		}
+		logger.Log("msg", "Tenant quotas enabled", "quotas", *quotaFile, "redis", *quotaRedis, "level", "info")
+	}
+
+	// Resilience domain. Deadlines apply to the whole call, including the time
+	// spent authenticating it.
+	timeouts := addsvc.TimeoutConfig{Default: addsvc.DefaultTimeouts}
+	if *timeoutsFile != "" {
+		config, err := addsvc.LoadTimeoutConfig(*timeoutsFile)
+		if err != nil {
+			logger.Log("msg", "Failed to load the timeouts", "err", err, "level", "crit")
+			os.Exit(1)
+		}
+		timeouts = config
+	}
+	deadline := func(method string) endpoint.Middleware {
+		return addsvc.DeadlineMiddleware(timeouts.Timeouts(method))
+	}
+
+	shedding := addsvc.DefaultSheddingConfig
+	if *shedFile != "" {
+		config, err := addsvc.LoadSheddingConfig(*shedFile)
+		if err != nil {
+			logger.Log("msg", "Failed to load the load shedding priorities", "err", err, "level", "crit")
+			os.Exit(1)
+		}
+		shedding = config
+	}
+	shedder := addsvc.NewLoadShedder(addsvc.SheddingSettings{
+		MaxInFlight:  *shedMax,
+		MaxQueue:     *shedQueue,
+		MaxQueueTime: *shedWait,
+	}, shedInFlight, shedQueued, shedCalls)
+	shed := func(method string, priority addsvc.Priority) endpoint.Middleware {
+		if *shedMax == 0 {
+			return func(next endpoint.Endpoint) endpoint.Endpoint { return next }
+		}
+		return addsvc.LoadSheddingMiddleware(shedder, shedding, method, priority)
+	}
+
+	retryConfig := addsvc.DefaultRetryConfig
+	if *retryFile != "" {
+		config, err := addsvc.LoadRetryConfig(*retryFile)
+		if err != nil {
+			logger.Log("msg", "Failed to load the retry policies", "err", err, "level", "crit")
+			os.Exit(1)
+		}
+		retryConfig = config
+	}
+	retry := func(method string) endpoint.Middleware {
+		return addsvc.RetryMiddleware(retryConfig.Policy(method), retries.With("method", method))
+	}
+
+	hedged := map[string]bool{}
+	for _, method := range strings.Split(*hedgeMethods, ",") {
+		if method = strings.TrimSpace(method); method == "" {
+			continue
+		}
+		if !retryConfig.Policy(method).Idempotent {
+			logger.Log("msg", "Only idempotent methods can be hedged", "method", method, "level", "crit")
+			os.Exit(1)
+		}
+		hedged[method] = true
+	}
+	hedge := func(method string) endpoint.Middleware {
+		if !hedged[method] {
+			return func(next endpoint.Endpoint) endpoint.Endpoint { return next }
+		}
+		delay := addsvc.QuantileHedgeDelay(latencies, method, *hedgeQuantile, time.Millisecond)
+		if *hedgeDelay > 0 {
+			delay = addsvc.FixedHedgeDelay(*hedgeDelay)
+		}
+		return addsvc.HedgingMiddleware(delay, hedges.With("method", method))
+	}
+
+	// Adaptive limits are kept per method, route tables may map several
+	// routes to the same method and are built concurrently.
+	adaptiveSettings := addsvc.DefaultAdaptiveLimitSettings
+	adaptiveSettings.InitialLimit = *adaptiveInitial
+	adaptiveSettings.MinLimit = *adaptiveMin
+	adaptiveSettings.MaxLimit = *adaptiveMax
+	adaptiveLimiters := map[string]*addsvc.AdaptiveLimiter{}
+	var adaptiveMtx sync.Mutex
+	adaptive := func(method string) endpoint.Middleware {
+		if !*adaptiveLimit {
+			return func(next endpoint.Endpoint) endpoint.Endpoint { return next }
+		}
+		adaptiveMtx.Lock()
+		defer adaptiveMtx.Unlock()
+		limiter, ok := adaptiveLimiters[method]
+		if !ok {
+			limiter = addsvc.NewAdaptiveLimiter(adaptiveSettings, adaptiveLimits.With("method", method))
+			latencies.Subscribe(method, limiter.Observe)
+			adaptiveLimiters[method] = limiter
+		}
+		return addsvc.AdaptiveLimitMiddleware(limiter, method, adaptiveRejected.With("method", method))
+	}
+
+	// Breakers and bulkheads are shared by every endpoint of a backend. Each
+	// hedged call and each retry goes through them.
+	breakerSettings := addsvc.DefaultBreakerSettings
+	breakerSettings.ConsecutiveFailures = *breakerFailures
+	breakerSettings.ErrorRatio = *breakerRatio
+	breakerSettings.OpenTimeout = *breakerTimeout
+	breakers := addsvc.NewCircuitBreakers(breakerSettings, breakerState, log.With(logger, "tag", "#breaker"))
+
+	limits, err := addsvc.ParseBulkheadLimits(*bulkheadLimits)
+	if err != nil {
+		logger.Log("msg", "Invalid bulkhead limits", "err", err, "level", "crit")
+		os.Exit(1)
+	}
+	bulkheads := addsvc.NewBulkheads(addsvc.BulkheadSettings{
+		MaxInFlight: *bulkheadMax,
+		MaxQueue:    *bulkheadQueue,
+		MaxWait:     *bulkheadWait,
+	}, limits, bulkheadInFlight, bulkheadQueued, bulkheadRejected)
+
 	var sayHelloEndpoint endpoint.Endpoint
 	{
 		sayHelloDuration := duration.With("method", "SayHello")
 		sayHelloLogger := log.With(logger, "method", "SayHello")
 
-		sayHelloEndpoint = addsvc.MakeSayHelloEndpoint(l5dConn)
+		sayHelloEndpoint = addsvc.BackendEndpoint(helloBackend, addsvc.MakeSayHelloEndpoint)
+		sayHelloEndpoint = addsvc.CircuitBreakerMiddleware(breakers.Get("grpc_types.Hello"))(sayHelloEndpoint)
+		sayHelloEndpoint = addsvc.BulkheadMiddleware(bulkheads.Get("grpc_types.Hello"))(sayHelloEndpoint)
+		sayHelloEndpoint = hedge("SayHello")(sayHelloEndpoint)
+		sayHelloEndpoint = retry("SayHello")(sayHelloEndpoint)
+		sayHelloEndpoint = adaptive("SayHello")(sayHelloEndpoint)
+		sayHelloEndpoint = quota("SayHello")(sayHelloEndpoint)
+		sayHelloEndpoint = rateLimit("SayHello")(sayHelloEndpoint)
+		sayHelloEndpoint = authorize("SayHello")(sayHelloEndpoint)
+		sayHelloEndpoint = authenticate("SayHello")(sayHelloEndpoint)
+		sayHelloEndpoint = shed("SayHello", shedding.Priority("SayHello"))(sayHelloEndpoint)
+		sayHelloEndpoint = deadline("SayHello")(sayHelloEndpoint)
 		sayHelloEndpoint = opentracing.TraceServer(tracer, "SayHello")(sayHelloEndpoint)
 		sayHelloEndpoint = addsvc.EndpointInstrumentingMiddleware(sayHelloDuration)(sayHelloEndpoint)
 		sayHelloEndpoint = addsvc.EndpointLoggingMiddleware(sayHelloLogger)(sayHelloEndpoint)
 	}
 
+	var sayWorldEndpoint endpoint.Endpoint
+	{
+		sayWorldDuration := duration.With("method", "SayWorld")
+		sayWorldLogger := log.With(logger, "method", "SayWorld")
+
+		sayWorldEndpoint = addsvc.BackendEndpoint(worldBackend, addsvc.MakeSayWorldEndpoint)
+		sayWorldEndpoint = addsvc.CircuitBreakerMiddleware(breakers.Get("grpc_types.World"))(sayWorldEndpoint)
+		sayWorldEndpoint = addsvc.BulkheadMiddleware(bulkheads.Get("grpc_types.World"))(sayWorldEndpoint)
+		sayWorldEndpoint = hedge("SayWorld")(sayWorldEndpoint)
+		sayWorldEndpoint = retry("SayWorld")(sayWorldEndpoint)
+		sayWorldEndpoint = adaptive("SayWorld")(sayWorldEndpoint)
+		sayWorldEndpoint = quota("SayWorld")(sayWorldEndpoint)
+		sayWorldEndpoint = rateLimit("SayWorld")(sayWorldEndpoint)
+		sayWorldEndpoint = authorize("SayWorld")(sayWorldEndpoint)
+		sayWorldEndpoint = authenticate("SayWorld")(sayWorldEndpoint)
+		sayWorldEndpoint = shed("SayWorld", shedding.Priority("SayWorld"))(sayWorldEndpoint)
+		sayWorldEndpoint = deadline("SayWorld")(sayWorldEndpoint)
+		sayWorldEndpoint = opentracing.TraceServer(tracer, "SayWorld")(sayWorldEndpoint)
+		sayWorldEndpoint = addsvc.EndpointInstrumentingMiddleware(sayWorldDuration)(sayWorldEndpoint)
+		sayWorldEndpoint = addsvc.EndpointLoggingMiddleware(sayWorldLogger)(sayWorldEndpoint)
+	}
+
+	var getAvailableAgentsEndpoint endpoint.Endpoint
+	{
+		getAvailableAgentsDuration := duration.With("method", "GetAvailableAgents")
+		getAvailableAgentsLogger := log.With(logger, "method", "GetAvailableAgents")
+
+		getAvailableAgentsEndpoint = addsvc.BackendEndpoint(agentBackend, addsvc.MakeGetAvailableAgentsEndpoint)
+		getAvailableAgentsEndpoint = addsvc.CircuitBreakerMiddleware(breakers.Get("grpc_types.AgentManagement"))(getAvailableAgentsEndpoint)
+		getAvailableAgentsEndpoint = addsvc.BulkheadMiddleware(bulkheads.Get("grpc_types.AgentManagement"))(getAvailableAgentsEndpoint)
+		getAvailableAgentsEndpoint = hedge("GetAvailableAgents")(getAvailableAgentsEndpoint)
+		getAvailableAgentsEndpoint = retry("GetAvailableAgents")(getAvailableAgentsEndpoint)
+		getAvailableAgentsEndpoint = adaptive("GetAvailableAgents")(getAvailableAgentsEndpoint)
+		getAvailableAgentsEndpoint = quota("GetAvailableAgents")(getAvailableAgentsEndpoint)
+		getAvailableAgentsEndpoint = rateLimit("GetAvailableAgents")(getAvailableAgentsEndpoint)
+		getAvailableAgentsEndpoint = authorize("GetAvailableAgents")(getAvailableAgentsEndpoint)
+		getAvailableAgentsEndpoint = authenticate("GetAvailableAgents")(getAvailableAgentsEndpoint)
+		getAvailableAgentsEndpoint = shed("GetAvailableAgents", shedding.Priority("GetAvailableAgents"))(getAvailableAgentsEndpoint)
+		getAvailableAgentsEndpoint = deadline("GetAvailableAgents")(getAvailableAgentsEndpoint)
+		getAvailableAgentsEndpoint = opentracing.TraceServer(tracer, "GetAvailableAgents")(getAvailableAgentsEndpoint)
+		getAvailableAgentsEndpoint = addsvc.EndpointInstrumentingMiddleware(getAvailableAgentsDuration)(getAvailableAgentsEndpoint)
+		getAvailableAgentsEndpoint = addsvc.EndpointLoggingMiddleware(getAvailableAgentsLogger)(getAvailableAgentsEndpoint)
+	}
+
+	var getAgentIDFromRefEndpoint endpoint.Endpoint
+	{
+		getAgentIDFromRefDuration := duration.With("method", "GetAgentIDFromRef")
+		getAgentIDFromRefLogger := log.With(logger, "method", "GetAgentIDFromRef")
+
+		getAgentIDFromRefEndpoint = addsvc.BackendEndpoint(agentBackend, addsvc.MakeGetAgentIDFromRefEndpoint)
+		getAgentIDFromRefEndpoint = addsvc.CircuitBreakerMiddleware(breakers.Get("grpc_types.AgentManagement"))(getAgentIDFromRefEndpoint)
+		getAgentIDFromRefEndpoint = addsvc.BulkheadMiddleware(bulkheads.Get("grpc_types.AgentManagement"))(getAgentIDFromRefEndpoint)
+		getAgentIDFromRefEndpoint = hedge("GetAgentIDFromRef")(getAgentIDFromRefEndpoint)
+		getAgentIDFromRefEndpoint = retry("GetAgentIDFromRef")(getAgentIDFromRefEndpoint)
+		getAgentIDFromRefEndpoint = adaptive("GetAgentIDFromRef")(getAgentIDFromRefEndpoint)
+		getAgentIDFromRefEndpoint = quota("GetAgentIDFromRef")(getAgentIDFromRefEndpoint)
+		getAgentIDFromRefEndpoint = rateLimit("GetAgentIDFromRef")(getAgentIDFromRefEndpoint)
+		getAgentIDFromRefEndpoint = authorize("GetAgentIDFromRef")(getAgentIDFromRefEndpoint)
+		getAgentIDFromRefEndpoint = authenticate("GetAgentIDFromRef")(getAgentIDFromRefEndpoint)
+		getAgentIDFromRefEndpoint = shed("GetAgentIDFromRef", shedding.Priority("GetAgentIDFromRef"))(getAgentIDFromRefEndpoint)
+		getAgentIDFromRefEndpoint = deadline("GetAgentIDFromRef")(getAgentIDFromRefEndpoint)
+		getAgentIDFromRefEndpoint = opentracing.TraceServer(tracer, "GetAgentIDFromRef")(getAgentIDFromRefEndpoint)
+		getAgentIDFromRefEndpoint = addsvc.EndpointInstrumentingMiddleware(getAgentIDFromRefDuration)(getAgentIDFromRefEndpoint)
+		getAgentIDFromRefEndpoint = addsvc.EndpointLoggingMiddleware(getAgentIDFromRefLogger)(getAgentIDFromRefEndpoint)
+	}
+
+	var acceptCallEndpoint endpoint.Endpoint
+	{
+		acceptCallDuration := duration.With("method", "AcceptCall")
+		acceptCallLogger := log.With(logger, "method", "AcceptCall")
+
+		acceptCallEndpoint = addsvc.BackendEndpoint(agentBackend, addsvc.MakeAcceptCallEndpoint)
+		acceptCallEndpoint = addsvc.CircuitBreakerMiddleware(breakers.Get("grpc_types.AgentManagement"))(acceptCallEndpoint)
+		acceptCallEndpoint = addsvc.BulkheadMiddleware(bulkheads.Get("grpc_types.AgentManagement"))(acceptCallEndpoint)
+		acceptCallEndpoint = hedge("AcceptCall")(acceptCallEndpoint)
+		acceptCallEndpoint = retry("AcceptCall")(acceptCallEndpoint)
+		acceptCallEndpoint = adaptive("AcceptCall")(acceptCallEndpoint)
+		acceptCallEndpoint = quota("AcceptCall")(acceptCallEndpoint)
+		acceptCallEndpoint = rateLimit("AcceptCall")(acceptCallEndpoint)
+		acceptCallEndpoint = authorize("AcceptCall")(acceptCallEndpoint)
+		acceptCallEndpoint = authenticate("AcceptCall")(acceptCallEndpoint)
+		acceptCallEndpoint = shed("AcceptCall", shedding.Priority("AcceptCall"))(acceptCallEndpoint)
+		acceptCallEndpoint = deadline("AcceptCall")(acceptCallEndpoint)
+		acceptCallEndpoint = opentracing.TraceServer(tracer, "AcceptCall")(acceptCallEndpoint)
+		acceptCallEndpoint = addsvc.EndpointInstrumentingMiddleware(acceptCallDuration)(acceptCallEndpoint)
+		acceptCallEndpoint = addsvc.EndpointLoggingMiddleware(acceptCallLogger)(acceptCallEndpoint)
+	}
+
+	var heartBeatEndpoint endpoint.Endpoint
+	{
+		heartBeatDuration := duration.With("method", "HeartBeat")
+		heartBeatLogger := log.With(logger, "method", "HeartBeat")
+
+		heartBeatEndpoint = addsvc.BackendEndpoint(agentBackend, addsvc.MakeHeartBeatEndpoint)
+		heartBeatEndpoint = addsvc.CircuitBreakerMiddleware(breakers.Get("grpc_types.AgentManagement"))(heartBeatEndpoint)
+		heartBeatEndpoint = addsvc.BulkheadMiddleware(bulkheads.Get("grpc_types.AgentManagement"))(heartBeatEndpoint)
+		heartBeatEndpoint = hedge("HeartBeat")(heartBeatEndpoint)
+		heartBeatEndpoint = retry("HeartBeat")(heartBeatEndpoint)
+		heartBeatEndpoint = adaptive("HeartBeat")(heartBeatEndpoint)
+		heartBeatEndpoint = quota("HeartBeat")(heartBeatEndpoint)
+		heartBeatEndpoint = rateLimit("HeartBeat")(heartBeatEndpoint)
+		heartBeatEndpoint = authorize("HeartBeat")(heartBeatEndpoint)
+		heartBeatEndpoint = authenticate("HeartBeat")(heartBeatEndpoint)
+		heartBeatEndpoint = shed("HeartBeat", shedding.Priority("HeartBeat"))(heartBeatEndpoint)
+		heartBeatEndpoint = deadline("HeartBeat")(heartBeatEndpoint)
+		heartBeatEndpoint = opentracing.TraceServer(tracer, "HeartBeat")(heartBeatEndpoint)
+		heartBeatEndpoint = addsvc.EndpointInstrumentingMiddleware(heartBeatDuration)(heartBeatEndpoint)
+		heartBeatEndpoint = addsvc.EndpointLoggingMiddleware(heartBeatLogger)(heartBeatEndpoint)
+	}
+
+	var addTaskEndpoint endpoint.Endpoint
+	{
+		addTaskDuration := duration.With("method", "AddTask")
+		addTaskLogger := log.With(logger, "method", "AddTask")
+
+		addTaskEndpoint = addsvc.BackendEndpoint(agentBackend, addsvc.MakeAddTaskEndpoint)
+		addTaskEndpoint = addsvc.CircuitBreakerMiddleware(breakers.Get("grpc_types.AgentManagement"))(addTaskEndpoint)
+		addTaskEndpoint = addsvc.BulkheadMiddleware(bulkheads.Get("grpc_types.AgentManagement"))(addTaskEndpoint)
+		addTaskEndpoint = hedge("AddTask")(addTaskEndpoint)
+		addTaskEndpoint = retry("AddTask")(addTaskEndpoint)
+		addTaskEndpoint = adaptive("AddTask")(addTaskEndpoint)
+		addTaskEndpoint = quota("AddTask")(addTaskEndpoint)
+		addTaskEndpoint = rateLimit("AddTask")(addTaskEndpoint)
+		addTaskEndpoint = authorize("AddTask")(addTaskEndpoint)
+		addTaskEndpoint = authenticate("AddTask")(addTaskEndpoint)
+		addTaskEndpoint = shed("AddTask", shedding.Priority("AddTask"))(addTaskEndpoint)
+		addTaskEndpoint = deadline("AddTask")(addTaskEndpoint)
+		addTaskEndpoint = opentracing.TraceServer(tracer, "AddTask")(addTaskEndpoint)
+		addTaskEndpoint = addsvc.EndpointInstrumentingMiddleware(addTaskDuration)(addTaskEndpoint)
+		addTaskEndpoint = addsvc.EndpointLoggingMiddleware(addTaskLogger)(addTaskEndpoint)
+	}
+
+	var pingEndpoint endpoint.Endpoint
+	{
+		pingDuration := duration.With("method", "Ping")
+		pingLogger := log.With(logger, "method", "Ping")
+
+		pingEndpoint = addsvc.BackendEndpoint(agentBackend, addsvc.MakePingEndpoint)
+		pingEndpoint = addsvc.CircuitBreakerMiddleware(breakers.Get("grpc_types.AgentManagement"))(pingEndpoint)
+		pingEndpoint = addsvc.BulkheadMiddleware(bulkheads.Get("grpc_types.AgentManagement"))(pingEndpoint)
+		pingEndpoint = hedge("Ping")(pingEndpoint)
+		pingEndpoint = retry("Ping")(pingEndpoint)
+		pingEndpoint = adaptive("Ping")(pingEndpoint)
+		pingEndpoint = quota("Ping")(pingEndpoint)
+		pingEndpoint = rateLimit("Ping")(pingEndpoint)
+		pingEndpoint = authorize("Ping")(pingEndpoint)
+		pingEndpoint = authenticate("Ping")(pingEndpoint)
+		pingEndpoint = shed("Ping", shedding.Priority("Ping"))(pingEndpoint)
+		pingEndpoint = deadline("Ping")(pingEndpoint)
+		pingEndpoint = opentracing.TraceServer(tracer, "Ping")(pingEndpoint)
+		pingEndpoint = addsvc.EndpointInstrumentingMiddleware(pingDuration)(pingEndpoint)
+		pingEndpoint = addsvc.EndpointLoggingMiddleware(pingLogger)(pingEndpoint)
+	}
+
 	endpoints := addsvc.Endpoints{
-		SayHelloEndpoint: sayHelloEndpoint,
+		SayHelloEndpoint:           sayHelloEndpoint,
+		SayWorldEndpoint:           sayWorldEndpoint,
+		GetAvailableAgentsEndpoint: getAvailableAgentsEndpoint,
+		GetAgentIDFromRefEndpoint:  getAgentIDFromRefEndpoint,
+		AcceptCallEndpoint:         acceptCallEndpoint,
+		HeartBeatEndpoint:          heartBeatEndpoint,
+		AddTaskEndpoint:            addTaskEndpoint,
+		PingEndpoint:               pingEndpoint,
+	}
+
+	// Transcoder domain.
+	transcoder, err := addsvc.NewGRPCTypesTranscoder()
+	if err != nil {
+		logger.Log("msg", "Failed to load the grpc_types descriptors", "err", err, "level", "crit")
+		os.Exit(1)
+	}
+
+	// routeMiddleware returns the middleware chain for the endpoints built
+	// from route tables
+	routeMiddleware := func(logger log.Logger) func(addsvc.Route, endpoint.Endpoint) endpoint.Endpoint {
+		return func(route addsvc.Route, e endpoint.Endpoint) endpoint.Endpoint {
+			e = addsvc.CircuitBreakerMiddleware(breakers.Get(route.Service))(e)
+			e = addsvc.BulkheadMiddleware(bulkheads.Get(route.Service))(e)
+			e = hedge(route.RPC)(e)
+			e = retry(route.RPC)(e)
+			e = adaptive(route.RPC)(e)
+			e = quota(route.RPC)(e)
+			e = rateLimit(route.RPC)(e)
+			e = authorize(route.RPC)(e)
+			e = authenticate(route.RPC)(e)
+			e = shed(route.RPC, shedding.RoutePriority(route))(e)
+			e = deadline(route.RPC)(e)
+			e = opentracing.TraceServer(tracer, route.RPC)(e)
+			e = addsvc.EndpointInstrumentingMiddleware(duration.With("method", route.RPC))(e)
+			e = addsvc.EndpointLoggingMiddleware(log.With(logger, "method", route.RPC))(e)
+			return e
+		}
 	}
 
 	// Interrupt handler.
@@ -291,48 +950,94 @@ func main() {
 		m.Handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
 		m.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
 		m.Handle("/metrics", promhttp.Handler())
+		m.Handle("/debug/breakers", addsvc.MakeCircuitBreakerDebugHandler(breakers))
+		m.Handle("/healthz", addsvc.MakeLivenessHandler())
+		m.Handle("/readyz", addsvc.MakeReadinessHandler(health))
 
 		logger.Log("addr", *debugAddr)
 		errc <- http.ListenAndServe(*debugAddr, m)
 	}()
 
 	// HTTP transport.
-	// go func() {
-	// 	logger := log.With(logger, "transport", "HTTP")
-	// 	h := addsvc.MakeHTTPHandler(endpoints, tracer, logger)
-	// 	logger.Log("addr", *httpAddr)
-	// 	errc <- http.ListenAndServe(*httpAddr, h)
-	// }()
+	go func() {
+		logger := log.With(logger, "transport", "HTTP")
+		h := addsvc.MakeHTTPHandler(endpoints, tracer, logger)
+
+		// Routes declared in the route table are served in front of the
+		// routes from google.api.http annotations, which are served in front
+		// of the built-in ones
+		var table addsvc.RouteTable
+		if *routesFile != "" {
+			var err error
+			table, err = addsvc.LoadRouteTable(*routesFile)
+			if err != nil {
+				errc <- err
+				return
+			}
+			for i := range table.Routes {
+				if table.Routes[i], err = transcoder.Resolve(table.Routes[i]); err != nil {
+					errc <- err
+					return
+				}
+			}
+			logger.Log("routes", len(table.Routes), "file", *routesFile, "tag", "#setup")
+		}
+		table.Routes = append(table.Routes, transcoder.AnnotatedRoutes()...)
+
+		if len(table.Routes) > 0 {
+			var err error
+			h, err = addsvc.MakeRouteTableHTTPHandler(table, backends, routeMiddleware(logger), h, tracer, logger)
+			if err != nil {
+				errc <- err
+				return
+			}
+		}
+
+		logger.Log("addr", *httpAddr, "tag", "#setup")
+		errc <- http.ListenAndServe(*httpAddr, h)
+	}()
 
 	// gRPC transport.
-	// go func() {
-	// 	logger := log.With(logger, "transport", "gRPC")
+	go func() {
+		logger := log.With(logger, "transport", "gRPC")
 
-	// 	ln, err := net.Listen("tcp", *grpcAddr)
-	// 	if err != nil {
-	// 		errc <- err
-	// 		return
-	// 	}
+		ln, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer ln.Close()
 
-	// 	srv := addsvc.MakeGRPCServer(endpoints, tracer, logger)
-	// 	s := grpc.NewServer()
-	// 	pb.RegisterAddServer(s, srv)
+		srv := addsvc.MakeAllServicesGRPCServer(endpoints, tracer, logger)
+		s := grpc.NewServer()
+		grpc_types.RegisterGlobalAPIServer(s, srv)
+		healthpb.RegisterHealthServer(s, health.GRPCServer())
+		defer s.GracefulStop()
 
-	// 	logger.Log("addr", *grpcAddr)
-	// 	errc <- s.Serve(ln)
-	// }()
+		logger.Log("addr", *grpcAddr, "tag", "#setup")
+		errc <- s.Serve(ln)
+	}()
 
 	// Enable - to connect to any gRPC service
-	// Should be set to false in production
+	// Should be set to false in production (the default). These listeners are
+	// separate from the public HTTP and gRPC transports above.
 	if *debugAnyGRPCService {
 
 		// HTTP transport for access to any internal service
 		go func() {
 			httpLogger := log.With(logger, "level", "info", "tag", "#debughttp", "transport", "http", "msg", "Debug Any service")
 			debugHTTPHandler := addsvc.MakeDebugHTTPHandler(endpoints, tracer, httpLogger)
+
+			// Any method of the grpc_types services at /rpc/<service>/<rpc>
+			rpcRoutes := addsvc.RouteTable{Routes: transcoder.RPCRoutes("/rpc")}
+			debugHTTPHandler, err := addsvc.MakeRouteTableHTTPHandler(rpcRoutes, backends, routeMiddleware(httpLogger), debugHTTPHandler, tracer, httpLogger)
+			if err != nil {
+				errc <- err
+				return
+			}
 			httpLogger.Log("addr", *httpAnyServiceAddr, "tag", "#setup")
 
-			errc <- http.ListenAndServe(*httpAnyServiceAddr, debugHTTPHandler)
+			errc <- http.ListenAndServe(*httpAnyServiceAddr, addsvc.PriorityHandler(addsvc.PrioritySheddable, debugHTTPHandler))
 		}()
 
 		// gRPC transport for access to any gRPC service.
@@ -346,8 +1051,27 @@ func main() {
 			}
 			defer ln.Close()
 
+			// Services in the allowlist that are not registered below are
+			// proxied as raw frames to the backends
+			serverOptions := []grpc.ServerOption{
+				grpc.UnaryInterceptor(addsvc.PriorityUnaryInterceptor(addsvc.PrioritySheddable)),
+			}
+			var allowed []string
+			for _, service := range strings.Split(*gRPCAnyServiceAllow, ",") {
+				if service = strings.TrimSpace(service); service != "" {
+					allowed = append(allowed, service)
+				}
+			}
+			if len(allowed) > 0 {
+				serverOptions = append(serverOptions,
+					grpc.CustomCodec(addsvc.ProxyCodec()),
+					grpc.UnknownServiceHandler(addsvc.MakeGRPCProxyHandler(proxyBackends, allowed, grpcLogger)),
+				)
+				grpcLogger.Log("proxy", strings.Join(allowed, ","), "tag", "#setup")
+			}
+
 			srvDebugAll := addsvc.MakeAllServicesGRPCServer(endpoints, tracer, grpcLogger)
-			sDebugAll := grpc.NewServer()
+			sDebugAll := grpc.NewServer(serverOptions...)
 			grpc_types.RegisterHelloServer(sDebugAll, srvDebugAll)
 			grpc_types.RegisterWorldServer(sDebugAll, srvDebugAll)
 			defer sDebugAll.GracefulStop()
@@ -359,4 +1083,11 @@ func main() {
 
 	// Run!
 	logger.Log("exit", <-errc)
+
+	for _, b := range []*addsvc.Backends{backends, proxyBackends} {
+		if err := b.Close(); err != nil {
+			backendLogger.Log("msg", "Failed to close the backend connections", "err", err, "level", "error")
+		}
+	}
+	backendLogger.Log("msg", "Closed the backend connections", "level", "info")
 }
@@ -0,0 +1,529 @@
+package addsvc
+
+// This file provides the connections to the backend services: connections
+// to each instance found by service discovery, the calls being spread over
+// them by a Balancer. Each backend service has its own connections, created
+// on first use, so that the flow control of one backend cannot hold up the
+// calls to the others. Instances failing repeatedly are ejected for a while,
+// so that a broken instance does not keep failing its share of the calls.
+//
+// Connections are dialed without blocking: the gateway starts whether or not
+// the backends are up, gRPC reconnecting in the background with exponential
+// backoff, and Ready reports whether the backends are connected.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/sd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
+)
+
+// BackendSettings configures the connections, balancing and outlier
+// ejection of the backends.
+type BackendSettings struct {
+	// Conns is the number of connections to each instance, the calls to the
+	// instance being spread over them i.e. to get past the concurrent
+	// streams limit of a single HTTP/2 connection.
+	Conns int
+	// Idle connections are pinged every KeepaliveTime (0 to disable), and
+	// closed if the ping is not answered within KeepaliveTimeout.
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+	// MaxMessageSize caps the size of the messages sent to and received
+	// from the backends (0 for the gRPC default of 4MB received).
+	MaxMessageSize int
+	// BackoffMaxDelay caps the delay between the attempts to reconnect to
+	// an instance (0 for the gRPC default of 2 minutes).
+	BackoffMaxDelay time.Duration
+
+	Balancer func() Balancer
+	// An instance failing ConsecutiveFailures calls in a row (0 to disable)
+	// is ejected for EjectionTime, unless more than MaxEjectedRatio of the
+	// instances would be ejected.
+	ConsecutiveFailures int
+	EjectionTime        time.Duration
+	MaxEjectedRatio     float64
+}
+
+// DefaultBackendSettings balance the calls round-robin over a connection to
+// each instance.
+var DefaultBackendSettings = BackendSettings{
+	Conns:               1,
+	KeepaliveTimeout:    20 * time.Second,
+	BackoffMaxDelay:     10 * time.Second,
+	Balancer:            NewRoundRobinBalancer,
+	ConsecutiveFailures: 5,
+	EjectionTime:        30 * time.Second,
+	MaxEjectedRatio:     0.5,
+}
+
+// dialOptions returns the dial options of the settings.
+func (s BackendSettings) dialOptions() []grpc.DialOption {
+	var options []grpc.DialOption
+	if s.KeepaliveTime > 0 {
+		options = append(options, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                s.KeepaliveTime,
+			Timeout:             s.KeepaliveTimeout,
+			PermitWithoutStream: true,
+		}))
+	}
+	if s.MaxMessageSize > 0 {
+		options = append(options, grpc.WithDefaultCallOptions(
+			grpc.MaxCallRecvMsgSize(s.MaxMessageSize),
+			grpc.MaxCallSendMsgSize(s.MaxMessageSize),
+		))
+	}
+	if s.BackoffMaxDelay > 0 {
+		options = append(options, grpc.WithBackoffMaxDelay(s.BackoffMaxDelay))
+	}
+	return options
+}
+
+// BackendInstance is an instance of a backend service.
+type BackendInstance struct {
+	outstanding int64 // first for 64-bit alignment
+	addr        string
+	conns       []*grpc.ClientConn
+	next        uint32
+
+	// Guarded by the backend lock
+	failures     int
+	ejectedUntil time.Time
+}
+
+// Addr returns the address of the instance.
+func (i *BackendInstance) Addr() string {
+	return i.addr
+}
+
+// conn returns the connections of the instance in turn.
+func (i *BackendInstance) conn() *grpc.ClientConn {
+	if len(i.conns) == 1 {
+		return i.conns[0]
+	}
+	return i.conns[atomic.AddUint32(&i.next, 1)%uint32(len(i.conns))]
+}
+
+func (i *BackendInstance) close() error {
+	var err error
+	for _, conn := range i.conns {
+		if closeErr := conn.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Outstanding returns the number of calls in flight to the instance.
+func (i *BackendInstance) Outstanding() int64 {
+	return atomic.LoadInt64(&i.outstanding)
+}
+
+// State returns the connectivity state of the instance, the best one among
+// its connections: ready if any of them is.
+func (i *BackendInstance) State() connectivity.State {
+	best := connectivity.Shutdown
+	for _, conn := range i.conns {
+		if state := conn.GetState(); stateRank(state) > stateRank(best) {
+			best = state
+		}
+	}
+	return best
+}
+
+// stateRank orders the connectivity states from the least to the most
+// usable.
+func stateRank(state connectivity.State) int {
+	switch state {
+	case connectivity.Ready:
+		return 4
+	case connectivity.Connecting:
+		return 3
+	case connectivity.Idle:
+		return 2
+	case connectivity.TransientFailure:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Backend keeps connections to each instance of a backend service,
+// following its discovery. It is safe for concurrent use.
+type Backend struct {
+	service   string
+	instancer sd.Instancer
+	settings  BackendSettings
+	balancer  Balancer
+	options   []grpc.DialOption
+	ejections metrics.Counter
+	logger    log.Logger
+	now       func() time.Time
+
+	events chan sd.Event
+	quit   chan struct{}
+
+	mtx       sync.Mutex
+	instances []*BackendInstance // by address
+	err       error              // of the last discovery event
+}
+
+// NewBackend returns a Backend connected to the instances of service found
+// by instancer, dialed with settings and options. Ejections are counted in ejections.
+func NewBackend(service string, instancer sd.Instancer, settings BackendSettings, ejections metrics.Counter, logger log.Logger, options ...grpc.DialOption) *Backend {
+	if settings.Balancer == nil {
+		settings.Balancer = NewRoundRobinBalancer
+	}
+	if settings.Conns < 1 {
+		settings.Conns = 1
+	}
+	b := &Backend{
+		service:   service,
+		instancer: instancer,
+		settings:  settings,
+		balancer:  settings.Balancer(),
+		options:   append(settings.dialOptions(), options...),
+		ejections: ejections,
+		logger:    logger,
+		now:       time.Now,
+		events:    make(chan sd.Event, 1),
+		quit:      make(chan struct{}),
+	}
+
+	// Instancers send their current instances on registration
+	instancer.Register(b.events)
+	b.update(<-b.events)
+	go b.watch()
+	return b
+}
+
+func (b *Backend) watch() {
+	for {
+		select {
+		case event := <-b.events:
+			b.update(event)
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+// update follows a discovery event, dialing the new instances and closing
+// the removed ones. Events with an error keep the instances in use.
+func (b *Backend) update(event sd.Event) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if event.Err != nil {
+		b.logger.Log("level", "error", "msg", "failed to discover the backend instances, keeping the previous ones", "service", b.service, "err", event.Err)
+		b.err = event.Err
+		return
+	}
+	b.err = nil
+
+	current := map[string]*BackendInstance{}
+	for _, instance := range b.instances {
+		current[instance.addr] = instance
+	}
+
+	var instances []*BackendInstance
+	for _, addr := range event.Instances {
+		if instance, ok := current[addr]; ok {
+			instances = append(instances, instance)
+			delete(current, addr)
+			continue
+		}
+		instance, err := b.dial(addr)
+		if err != nil {
+			b.logger.Log("level", "error", "msg", "failed to dial the backend instance", "service", b.service, "instance", addr, "err", err)
+			continue
+		}
+		instances = append(instances, instance)
+		b.logger.Log("level", "info", "msg", "added the backend instance", "service", b.service, "instance", addr, "conns", len(instance.conns))
+	}
+	for addr, instance := range current {
+		instance.close()
+		b.logger.Log("level", "info", "msg", "removed the backend instance", "service", b.service, "instance", addr)
+	}
+
+	sort.Slice(instances, func(i, j int) bool { return instances[i].addr < instances[j].addr })
+	b.instances = instances
+}
+
+// dial opens the connections to a new instance.
+func (b *Backend) dial(addr string) (*BackendInstance, error) {
+	instance := &BackendInstance{addr: addr}
+	for len(instance.conns) < b.settings.Conns {
+		conn, err := grpc.Dial(addr, b.options...)
+		if err != nil {
+			instance.close()
+			return nil, err
+		}
+		instance.conns = append(instance.conns, conn)
+		go b.logStates(addr, conn)
+	}
+	return instance, nil
+}
+
+// logStates logs the connectivity state transitions of a connection to the
+// instance addr until the connection is closed.
+func (b *Backend) logStates(addr string, conn *grpc.ClientConn) {
+	state := conn.GetState()
+	for state != connectivity.Shutdown {
+		if !conn.WaitForStateChange(context.Background(), state) {
+			return
+		}
+		from := state
+		state = conn.GetState()
+		level := "info"
+		if state == connectivity.TransientFailure {
+			level = "warn"
+		}
+		b.logger.Log("level", level, "msg", "backend connection state changed", "service", b.service, "instance", addr, "from", from.String(), "to", state.String())
+	}
+}
+
+// Instances returns the instances of the backend.
+func (b *Backend) Instances() []*BackendInstance {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return append([]*BackendInstance{}, b.instances...)
+}
+
+// Ready returns nil if an instance of the backend is connected, and why not
+// otherwise.
+func (b *Backend) Ready() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if len(b.instances) == 0 {
+		if b.err != nil {
+			return fmt.Errorf("no instances of %s: %v", b.service, b.err)
+		}
+		return fmt.Errorf("no instances of %s", b.service)
+	}
+	states := make([]string, 0, len(b.instances))
+	for _, instance := range b.instances {
+		state := instance.State()
+		if state == connectivity.Ready {
+			return nil
+		}
+		states = append(states, instance.addr+" "+state.String())
+	}
+	return fmt.Errorf("no connected instances of %s: %s", b.service, strings.Join(states, ", "))
+}
+
+// Pick returns the connection to the instance serving a call made with ctx,
+// and a function to call with the outcome of the call. Ejected instances are
+// skipped, unless every instance is ejected.
+func (b *Backend) Pick(ctx context.Context) (*grpc.ClientConn, func(error), error) {
+	b.mtx.Lock()
+	if len(b.instances) == 0 {
+		err := b.err
+		b.mtx.Unlock()
+		if err != nil {
+			return nil, nil, rejectionError(codes.Unavailable, "backend", b.service, "no instances of %s: %v", b.service, err)
+		}
+		return nil, nil, rejectionError(codes.Unavailable, "backend", b.service, "no instances of %s", b.service)
+	}
+
+	now := b.now()
+	available := make([]*BackendInstance, 0, len(b.instances))
+	for _, instance := range b.instances {
+		if !now.Before(instance.ejectedUntil) {
+			available = append(available, instance)
+		}
+	}
+	if len(available) == 0 {
+		available = b.instances
+	}
+	instance := b.balancer.Pick(available)
+	b.mtx.Unlock()
+
+	atomic.AddInt64(&instance.outstanding, 1)
+	return instance.conn(), func(err error) {
+		atomic.AddInt64(&instance.outstanding, -1)
+		b.observe(ctx, instance, err)
+	}, nil
+}
+
+// observe counts the consecutive failures of instance, ejecting it when
+// they reach the threshold. Only the errors blaming the instance rather than
+// the call count as failures, and the faults of the caller of ctx are not
+// counted at all.
+func (b *Backend) observe(ctx context.Context, instance *BackendInstance, err error) {
+	if callerFault(ctx, err) {
+		return
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	switch grpc.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal:
+	default:
+		instance.failures = 0
+		return
+	}
+	instance.failures++
+	if b.settings.ConsecutiveFailures < 1 || instance.failures < b.settings.ConsecutiveFailures {
+		return
+	}
+
+	now := b.now()
+	if now.Before(instance.ejectedUntil) {
+		return
+	}
+	ejected := 1
+	for _, i := range b.instances {
+		if now.Before(i.ejectedUntil) {
+			ejected++
+		}
+	}
+	if float64(ejected) > b.settings.MaxEjectedRatio*float64(len(b.instances)) {
+		return
+	}
+
+	instance.failures = 0
+	instance.ejectedUntil = now.Add(b.settings.EjectionTime)
+	b.ejections.Add(1)
+	b.logger.Log("level", "warn", "msg", "ejected the failing backend instance", "service", b.service, "instance", instance.addr, "until", instance.ejectedUntil.Format(time.RFC3339), "err", err)
+}
+
+// Close stops following the discovery and closes the connections.
+func (b *Backend) Close() error {
+	close(b.quit)
+
+	// Drain the events while deregistering, the instancer may be blocked
+	// notifying the backend
+	done := make(chan struct{})
+	go func() {
+		b.instancer.Deregister(b.events)
+		close(done)
+	}()
+	for draining := true; draining; {
+		select {
+		case <-b.events:
+		case <-done:
+			draining = false
+		}
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	var err error
+	for _, instance := range b.instances {
+		if closeErr := instance.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	b.instances = nil
+	return err
+}
+
+// BackendEndpoint returns an endpoint calling the endpoint made by
+// makeEndpoint (i.e. MakeSayHelloEndpoint) for the instance of backend
+// picked for each call.
+func BackendEndpoint(backend *Backend, makeEndpoint func(*grpc.ClientConn) endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		conn, done, err := backend.Pick(ctx)
+		if err != nil {
+			return nil, err
+		}
+		response, err = makeEndpoint(conn)(ctx, request)
+		done(err)
+		return response, err
+	}
+}
+
+// Backends holds a Backend per backend service, created on first use. It is
+// safe for concurrent use.
+type Backends struct {
+	discovery Discovery
+	settings  BackendSettings
+	ejections metrics.Counter
+	logger    log.Logger
+	options   []grpc.DialOption
+
+	mtx      sync.Mutex
+	backends map[string]*Backend
+}
+
+// NewBackends returns the backends resolved by discovery, their instances
+// dialed with settings and options. Nothing is dialed until a backend is
+// first used. The ejections counter must be labelled by backend.
+func NewBackends(discovery Discovery, settings BackendSettings, ejections metrics.Counter, logger log.Logger, options ...grpc.DialOption) *Backends {
+	return &Backends{
+		discovery: discovery,
+		settings:  settings,
+		ejections: ejections,
+		logger:    logger,
+		options:   options,
+		backends:  map[string]*Backend{},
+	}
+}
+
+// Get returns the backend of service i.e. grpc_types.Hello.
+func (bs *Backends) Get(service string) (*Backend, error) {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+
+	if b, ok := bs.backends[service]; ok {
+		return b, nil
+	}
+	instancer, err := bs.discovery.Instancer(service)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", service, err)
+	}
+	b := NewBackend(service, instancer, bs.settings, bs.ejections.With("backend", service), bs.logger, bs.options...)
+	bs.backends[service] = b
+	return b, nil
+}
+
+// Ready returns nil if every backend in use is ready, and why not
+// otherwise.
+func (bs *Backends) Ready() error {
+	bs.mtx.Lock()
+	backends := make([]*Backend, 0, len(bs.backends))
+	for _, b := range bs.backends {
+		backends = append(backends, b)
+	}
+	bs.mtx.Unlock()
+
+	sort.Slice(backends, func(i, j int) bool { return backends[i].service < backends[j].service })
+	for _, b := range backends {
+		if err := b.Ready(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the connections to the backends, failing the calls still in
+// flight.
+func (bs *Backends) Close() error {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+
+	var err error
+	for service, b := range bs.backends {
+		if closeErr := b.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		delete(bs.backends, service)
+	}
+	return err
+}
@@ -0,0 +1,217 @@
+package addsvc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/go-kit/kit/sd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+)
+
+func TestBackendOutlierEjection(t *testing.T) {
+	settings := BackendSettings{
+		Balancer:            NewRoundRobinBalancer,
+		ConsecutiveFailures: 3,
+		EjectionTime:        time.Minute,
+		MaxEjectedRatio:     0.5,
+	}
+	b := NewBackend("grpc_types.Hello", sd.FixedInstancer{"127.0.0.1:1", "127.0.0.1:2"}, settings, discard.NewCounter(), log.NewNopLogger(), grpc.WithInsecure())
+	defer b.Close()
+
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	instances := b.Instances()
+	if len(instances) != 2 {
+		t.Fatalf("want 2 instances, have %d", len(instances))
+	}
+	bad := instances[0]
+
+	// Calls to the bad instance fail until it is ejected
+	unavailable := grpc.Errorf(codes.Unavailable, "connection refused")
+	for failures := 0; failures < 3; {
+		conn, done, err := b.Pick(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn == bad.conns[0] {
+			done(unavailable)
+			failures++
+		} else {
+			done(nil)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		conn, done, _ := b.Pick(context.Background())
+		if conn == bad.conns[0] {
+			t.Fatal("want the failing instance ejected")
+		}
+		// Failing the other one as well does not eject every instance
+		done(unavailable)
+	}
+
+	// The instance is back after the ejection time
+	now = now.Add(time.Minute)
+	picked := false
+	for i := 0; i < 2; i++ {
+		conn, done, _ := b.Pick(context.Background())
+		picked = picked || conn == bad.conns[0]
+		done(nil)
+	}
+	if !picked {
+		t.Error("want the instance back")
+	}
+}
+
+func TestBackendEndpointNoInstances(t *testing.T) {
+	b := NewBackend("grpc_types.Hello", sd.FixedInstancer{}, DefaultBackendSettings, discard.NewCounter(), log.NewNopLogger(), grpc.WithInsecure())
+	defer b.Close()
+
+	e := BackendEndpoint(b, func(*grpc.ClientConn) endpoint.Endpoint {
+		t.Fatal("want no call without instances")
+		return nil
+	})
+	if _, err := e(context.Background(), nil); grpc.Code(err) != codes.Unavailable {
+		t.Errorf("want Unavailable, have %v", err)
+	}
+}
+
+func TestBackendsUnknownService(t *testing.T) {
+	backends := NewBackends(StaticDiscovery{"grpc_types.Hello": {"127.0.0.1:1"}}, DefaultBackendSettings, discard.NewCounter(), log.NewNopLogger(), grpc.WithInsecure())
+	defer backends.Close()
+
+	if _, err := backends.Get("grpc_types.World"); err == nil {
+		t.Error("want an error for a service without instances")
+	}
+	b, err := backends.Get("grpc_types.Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := backends.Get("grpc_types.Hello"); again != b {
+		t.Error("want the same backend")
+	}
+}
+
+func TestBackendConns(t *testing.T) {
+	settings := DefaultBackendSettings
+	settings.Conns = 3
+	settings.KeepaliveTime = time.Minute
+	settings.MaxMessageSize = 16 << 20
+	b := NewBackend("grpc_types.Hello", sd.FixedInstancer{"127.0.0.1:1"}, settings, discard.NewCounter(), log.NewNopLogger(), grpc.WithInsecure())
+
+	instances := b.Instances()
+	if len(instances) != 1 || len(instances[0].conns) != 3 {
+		t.Fatalf("want 3 connections to a single instance, have %v", instances)
+	}
+
+	// The calls are spread over the connections
+	picked := map[*grpc.ClientConn]bool{}
+	for i := 0; i < 3; i++ {
+		conn, done, err := b.Pick(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked[conn] = true
+		done(nil)
+	}
+	if len(picked) != 3 {
+		t.Errorf("want 3 connections used, have %d", len(picked))
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.Pick(context.Background()); grpc.Code(err) != codes.Unavailable {
+		t.Errorf("want Unavailable once closed, have %v", err)
+	}
+}
+
+func TestBackendReady(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	go server.Serve(ln)
+
+	settings := DefaultBackendSettings
+	settings.BackoffMaxDelay = 100 * time.Millisecond
+	bs := NewBackends(StaticDiscovery{"*": {ln.Addr().String()}}, settings, discard.NewCounter(), log.NewNopLogger(), grpc.WithInsecure())
+	defer bs.Close()
+
+	if err := bs.Ready(); err != nil {
+		t.Fatalf("want no backends in use ready, have %v", err)
+	}
+	b, err := bs.Get("grpc_types.Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitReady := func(ready bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for (bs.Ready() == nil) != ready {
+			if time.Now().After(deadline) {
+				t.Fatalf("want ready %v, have %v", ready, bs.Ready())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Connected in the background
+	waitReady(true)
+	if state := b.Instances()[0].State(); state != connectivity.Ready {
+		t.Errorf("want ready, have %s", state)
+	}
+
+	// Not ready once the instance is gone
+	server.Stop()
+	waitReady(false)
+}
+
+func TestBackendCallerDeadline(t *testing.T) {
+	settings := BackendSettings{
+		Balancer:            NewRoundRobinBalancer,
+		ConsecutiveFailures: 2,
+		EjectionTime:        time.Minute,
+		MaxEjectedRatio:     1,
+	}
+	b := NewBackend("grpc_types.Hello", sd.FixedInstancer{"127.0.0.1:1"}, settings, discard.NewCounter(), log.NewNopLogger(), grpc.WithInsecure())
+	defer b.Close()
+
+	ejected := func() bool {
+		b.mtx.Lock()
+		defer b.mtx.Unlock()
+		return b.now().Before(b.instances[0].ejectedUntil)
+	}
+	deadlineExceeded := grpc.Errorf(codes.DeadlineExceeded, "context deadline exceeded")
+
+	// Calls exceeding the deadline of their caller do not eject the instance
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	for i := 0; i < 5; i++ {
+		_, done, err := b.Pick(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done(deadlineExceeded)
+	}
+	if ejected() {
+		t.Fatal("want the instance kept after calls exceeding the deadline of the caller")
+	}
+
+	// Calls exceeding the gateway timeout do
+	ctx = context.WithValue(ctx, callerDeadlineContextKey{}, time.Time{})
+	for i := 0; i < 2; i++ {
+		_, done, _ := b.Pick(ctx)
+		done(deadlineExceeded)
+	}
+	if !ejected() {
+		t.Error("want the instance ejected after calls exceeding the gateway timeout")
+	}
+}
@@ -0,0 +1,204 @@
+package addsvc
+
+// This file provides per-method deadlines. Every call gets a deadline, so
+// that a stuck backend cannot hold a gateway request forever: the one set by
+// the caller, with the grpc-timeout or X-Request-Timeout header, or the
+// method default. Either way it is capped by the method maximum.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type (
+	requestTimeoutContextKey struct{}
+	callerDeadlineContextKey struct{}
+)
+
+// callerDeadlineSlack is how early before the deadline of the caller a
+// deadline exceeded error may come back, the backend counting down its own
+// copy of the deadline.
+const callerDeadlineSlack = 5 * time.Millisecond
+
+// Timeouts holds the default and maximum timeout of a method. A zero value
+// means no default timeout or no maximum.
+type Timeouts struct {
+	Default duration `toml:"default"`
+	Max     duration `toml:"max"`
+}
+
+// DefaultTimeouts apply to methods without timeouts of their own, unless
+// overridden by a TimeoutConfig.
+var DefaultTimeouts = Timeouts{
+	Default: duration(10 * time.Second),
+	Max:     duration(60 * time.Second),
+}
+
+// TimeoutConfig holds the timeouts of the gateway methods, loaded from a TOML
+// file i.e.
+//
+//	[default]
+//	default = "10s"
+//	max = "1m"
+//
+//	[methods.GetAvailableAgents]
+//	default = "500ms"
+//	max = "2s"
+type TimeoutConfig struct {
+	Default Timeouts            `toml:"default"`
+	Methods map[string]Timeouts `toml:"methods"`
+}
+
+// LoadTimeoutConfig reads a TOML timeout file.
+func LoadTimeoutConfig(filename string) (TimeoutConfig, error) {
+	config := TimeoutConfig{Default: DefaultTimeouts}
+	_, err := toml.DecodeFile(filename, &config)
+	return config, err
+}
+
+// Timeouts returns the timeouts of method.
+func (c TimeoutConfig) Timeouts(method string) Timeouts {
+	if t, ok := c.Methods[method]; ok {
+		return t
+	}
+	return c.Default
+}
+
+// RequestTimeoutHTTPToContext moves the timeout requested with the
+// X-Request-Timeout header, a duration such as "1.5s" or a number of
+// seconds, or with the grpc-timeout header, into the context.
+func RequestTimeoutHTTPToContext() httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		if v := r.Header.Get("X-Request-Timeout"); v != "" {
+			return context.WithValue(ctx, requestTimeoutContextKey{}, requestTimeout{value: v, parse: parseRequestTimeout})
+		}
+		if v := r.Header.Get("Grpc-Timeout"); v != "" {
+			return context.WithValue(ctx, requestTimeoutContextKey{}, requestTimeout{value: v, parse: parseGRPCTimeout})
+		}
+		return ctx
+	}
+}
+
+// requestTimeout is parsed by DeadlineMiddleware, so that invalid values can
+// be rejected.
+type requestTimeout struct {
+	value string
+	parse func(string) (time.Duration, error)
+}
+
+// DeadlineMiddleware returns an endpoint middleware running calls with a
+// deadline. The deadline of the incoming context, set by gRPC callers with
+// grpc-timeout, or the timeout requested by HTTP callers is honoured, else the
+// default timeout applies; it is capped by the maximum timeout either way.
+// Calls exceeding their deadline fail with codes.DeadlineExceeded (504 over
+// HTTP).
+func DeadlineMiddleware(timeouts Timeouts) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			timeout := time.Duration(timeouts.Default)
+			if deadline, ok := ctx.Deadline(); ok {
+				if timeout = time.Until(deadline); timeout <= 0 {
+					return nil, status.Error(codes.DeadlineExceeded, "deadline exceeded before the call")
+				}
+			} else if requested, ok := ctx.Value(requestTimeoutContextKey{}).(requestTimeout); ok {
+				if timeout, err = requested.parse(requested.value); err != nil || timeout <= 0 {
+					return nil, status.Errorf(codes.InvalidArgument, "invalid request timeout %q", requested.value)
+				}
+			}
+			_, requested := ctx.Value(requestTimeoutContextKey{}).(requestTimeout)
+			_, hasDeadline := ctx.Deadline()
+			fromCaller := requested || hasDeadline
+			if max := time.Duration(timeouts.Max); max > 0 && (timeout == 0 || timeout > max) {
+				timeout, fromCaller = max, false
+			}
+
+			// The deadline of the caller is recorded, so that the calls
+			// exceeding it do not count against the backends
+			var deadline time.Time
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+				if fromCaller {
+					deadline, _ = ctx.Deadline()
+				}
+			}
+			ctx = context.WithValue(ctx, callerDeadlineContextKey{}, deadline)
+
+			response, err = next(ctx, request)
+			if err != nil && (err == context.DeadlineExceeded || ctx.Err() == context.DeadlineExceeded) && grpc.Code(err) != codes.DeadlineExceeded {
+				return nil, status.Errorf(codes.DeadlineExceeded, "deadline of %s exceeded", timeout)
+			}
+			return response, err
+		}
+	}
+}
+
+// callerDeadline returns the deadline set by the caller of the gateway, if
+// it is the one bounding the call. Without DeadlineMiddleware, the deadline
+// of ctx is the caller's.
+func callerDeadline(ctx context.Context) (time.Time, bool) {
+	if deadline, ok := ctx.Value(callerDeadlineContextKey{}).(time.Time); ok {
+		return deadline, !deadline.IsZero()
+	}
+	return ctx.Deadline()
+}
+
+// callerFault reports whether err is the doing of the caller rather than of
+// the backend: the call was canceled, or the deadline set by the caller was
+// exceeded. Such errors must not count as backend failures, or any caller
+// could open a breaker or eject the instances with tiny deadlines.
+func callerFault(ctx context.Context, err error) bool {
+	switch {
+	case err == context.Canceled || grpc.Code(err) == codes.Canceled:
+		return true
+	case err == context.DeadlineExceeded || grpc.Code(err) == codes.DeadlineExceeded:
+		deadline, ok := callerDeadline(ctx)
+		return ok && time.Until(deadline) < callerDeadlineSlack
+	}
+	return false
+}
+
+// parseRequestTimeout parses a duration or a number of seconds.
+func parseRequestTimeout(s string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// parseGRPCTimeout parses a grpc-timeout value i.e. 100m for 100
+// milliseconds.
+func parseGRPCTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+	}
+
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+	unit, ok := units[s[len(s)-1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid grpc-timeout unit in %q", s)
+	}
+	return time.Duration(n) * unit, nil
+}
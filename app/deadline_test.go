@@ -0,0 +1,70 @@
+package addsvc
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestDeadlineMiddleware(t *testing.T) {
+	var remaining time.Duration
+	e := DeadlineMiddleware(Timeouts{Default: duration(time.Second), Max: duration(5 * time.Second)})(func(ctx context.Context, _ interface{}) (interface{}, error) {
+		deadline, _ := ctx.Deadline()
+		remaining = time.Until(deadline)
+		return nil, nil
+	})
+
+	requestContext := func(header, value string) context.Context {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(header, value)
+		return RequestTimeoutHTTPToContext()(context.Background(), r)
+	}
+	grpcContext, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		want time.Duration
+	}{
+		{"default", context.Background(), time.Second},
+		{"X-Request-Timeout duration", requestContext("X-Request-Timeout", "2s"), 2 * time.Second},
+		{"X-Request-Timeout seconds", requestContext("X-Request-Timeout", "2.5"), 2500 * time.Millisecond},
+		{"grpc-timeout header", requestContext("Grpc-Timeout", "3000m"), 3 * time.Second},
+		{"capped", requestContext("X-Request-Timeout", "1h"), 5 * time.Second},
+		{"gRPC deadline", grpcContext, 3 * time.Second},
+	} {
+		if _, err := e(tc.ctx, nil); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if remaining > tc.want || remaining < tc.want-100*time.Millisecond {
+			t.Errorf("%s: want a %v deadline, have %v", tc.name, tc.want, remaining)
+		}
+	}
+
+	if _, err := e(requestContext("X-Request-Timeout", "soon"), nil); grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("want InvalidArgument for an invalid timeout, have %v", err)
+	}
+}
+
+func TestDeadlineMiddlewareExceeded(t *testing.T) {
+	e := DeadlineMiddleware(Timeouts{Default: duration(10 * time.Millisecond)})(func(ctx context.Context, _ interface{}) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	_, err := e(context.Background(), nil)
+	if grpc.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("want DeadlineExceeded, have %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	errorEncoder(context.Background(), err, rec)
+	if rec.Code != 504 {
+		t.Errorf("want 504, have %d", rec.Code)
+	}
+}
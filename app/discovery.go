@@ -0,0 +1,270 @@
+package addsvc
+
+// This file provides service discovery: resolving each backend service, i.e.
+// grpc_types.Hello, to the addresses of its instances. The instances are
+// watched through go-kit sd.Instancers, so that the gateway can reach the
+// backends directly as well as through linkerd.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/dnssrv"
+)
+
+// Discovery resolves the backend services to their instances.
+type Discovery interface {
+	// Instancer returns the instancer of service i.e. grpc_types.Hello.
+	Instancer(service string) (sd.Instancer, error)
+}
+
+// StaticDiscovery maps each backend service to a fixed set of instances.
+// The instances of "*" serve the services not listed i.e. linkerd.
+type StaticDiscovery map[string][]string
+
+// Instancer implements Discovery.
+func (d StaticDiscovery) Instancer(service string) (sd.Instancer, error) {
+	instances, ok := d[service]
+	if !ok {
+		instances, ok = d["*"]
+	}
+	if !ok {
+		return nil, fmt.Errorf("no instances of %s", service)
+	}
+	return sd.FixedInstancer(instances), nil
+}
+
+// ParseStaticDiscovery parses comma separated service=address pairs, a
+// service being repeated for each of its instances i.e.
+// grpc_types.Hello=10.0.0.1:50051,grpc_types.Hello=10.0.0.2:50051,*=linkerd:4141
+func ParseStaticDiscovery(s string) (StaticDiscovery, error) {
+	d := StaticDiscovery{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i <= 0 || i == len(pair)-1 {
+			return nil, fmt.Errorf("invalid instance %q, want service=address", pair)
+		}
+		d[pair[:i]] = append(d[pair[:i]], pair[i+1:])
+	}
+	return d, nil
+}
+
+// DNSSRVDiscovery resolves the backend services with DNS SRV records, named
+// after a template i.e. _grpc._tcp.{service}.default.svc.cluster.local where
+// {service} is the service as a DNS label: grpc-types-hello for
+// grpc_types.Hello. The records are resolved again every ttl.
+type DNSSRVDiscovery struct {
+	template string
+	ttl      time.Duration
+	lookup   dnssrv.Lookup
+	logger   log.Logger
+
+	mtx        sync.Mutex
+	instancers map[string]*dnssrv.Instancer
+}
+
+// NewDNSSRVDiscovery returns a DNSSRVDiscovery.
+func NewDNSSRVDiscovery(template string, ttl time.Duration, logger log.Logger) *DNSSRVDiscovery {
+	return &DNSSRVDiscovery{
+		template:   template,
+		ttl:        ttl,
+		lookup:     net.LookupSRV,
+		logger:     logger,
+		instancers: map[string]*dnssrv.Instancer{},
+	}
+}
+
+// Instancer implements Discovery.
+func (d *DNSSRVDiscovery) Instancer(service string) (sd.Instancer, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	instancer, ok := d.instancers[service]
+	if !ok {
+		name := strings.Replace(d.template, "{service}", dnsLabel(service), -1)
+		instancer = dnssrv.NewInstancerDetailed(name, time.NewTicker(d.ttl), d.lookup, log.With(d.logger, "service", service))
+		d.instancers[service] = instancer
+	}
+	return instancer, nil
+}
+
+// Stop stops resolving the records.
+func (d *DNSSRVDiscovery) Stop() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	for service, instancer := range d.instancers {
+		instancer.Stop()
+		delete(d.instancers, service)
+	}
+}
+
+// dnsLabel turns a service name into a DNS label, lower case letters, digits
+// and hyphens.
+func dnsLabel(service string) string {
+	return strings.Trim(strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, service), "-")
+}
+
+// FileDiscovery reads the instances of the backend services from a TOML file
+// i.e.
+//
+//	[services]
+//	"grpc_types.Hello" = ["10.0.0.1:50051", "10.0.0.2:50051"]
+//	"*" = ["linkerd:4141"]
+//
+// The instances of "*" serve the services not listed. The file is reloaded
+// by Watch when modified, and the instancers notify their observers.
+type FileDiscovery struct {
+	filename string
+
+	mtx        sync.Mutex
+	modTime    time.Time
+	services   map[string][]string
+	instancers map[string]*fileInstancer
+}
+
+// NewFileDiscovery returns a FileDiscovery reading filename.
+func NewFileDiscovery(filename string) (*FileDiscovery, error) {
+	d := &FileDiscovery{filename: filename, instancers: map[string]*fileInstancer{}}
+	if _, err := d.Reload(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Instancer implements Discovery.
+func (d *FileDiscovery) Instancer(service string) (sd.Instancer, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	instancer, ok := d.instancers[service]
+	if !ok {
+		instancer = &fileInstancer{discovery: d, service: service, observers: map[chan<- sd.Event]bool{}}
+		d.instancers[service] = instancer
+	}
+	return instancer, nil
+}
+
+// event returns the instances of service. d.mtx must be held.
+func (d *FileDiscovery) event(service string) sd.Event {
+	instances, ok := d.services[service]
+	if !ok {
+		instances, ok = d.services["*"]
+	}
+	if !ok {
+		return sd.Event{Err: fmt.Errorf("%s: no instances of %s", d.filename, service)}
+	}
+	return sd.Event{Instances: instances}
+}
+
+// Reload reads the file again if it was modified since it was last loaded,
+// and reports whether it did. The instances in use are kept if the file is
+// invalid.
+func (d *FileDiscovery) Reload() (bool, error) {
+	info, err := os.Stat(d.filename)
+	if err != nil {
+		return false, err
+	}
+
+	d.mtx.Lock()
+	unchanged := d.services != nil && info.ModTime().Equal(d.modTime)
+	d.mtx.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	var file struct {
+		Services map[string][]string `toml:"services"`
+	}
+	if _, err := toml.DecodeFile(d.filename, &file); err != nil {
+		return false, err
+	}
+	if file.Services == nil {
+		file.Services = map[string][]string{}
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.services = file.Services
+	d.modTime = info.ModTime()
+	for service, instancer := range d.instancers {
+		instancer.notify(d.event(service))
+	}
+	return true, nil
+}
+
+// Watch reloads the file every interval until ctx is done.
+func (d *FileDiscovery) Watch(ctx context.Context, interval time.Duration, logger log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := d.Reload()
+			if err != nil {
+				logger.Log("level", "error", "msg", "failed to reload the backend instances, keeping the previous ones", "file", d.filename, "err", err)
+				continue
+			}
+			if reloaded {
+				logger.Log("level", "info", "msg", "reloaded the backend instances", "file", d.filename)
+			}
+		}
+	}
+}
+
+// fileInstancer is the sd.Instancer of a service of a FileDiscovery. Its
+// methods are called with the discovery lock held, or take it.
+type fileInstancer struct {
+	discovery *FileDiscovery
+	service   string
+	observers map[chan<- sd.Event]bool
+}
+
+// Register implements sd.Instancer.
+func (i *fileInstancer) Register(ch chan<- sd.Event) {
+	i.discovery.mtx.Lock()
+	defer i.discovery.mtx.Unlock()
+
+	i.observers[ch] = true
+	ch <- i.discovery.event(i.service)
+}
+
+// Deregister implements sd.Instancer.
+func (i *fileInstancer) Deregister(ch chan<- sd.Event) {
+	i.discovery.mtx.Lock()
+	defer i.discovery.mtx.Unlock()
+
+	delete(i.observers, ch)
+}
+
+// Stop implements sd.Instancer.
+func (i *fileInstancer) Stop() {}
+
+func (i *fileInstancer) notify(event sd.Event) {
+	for ch := range i.observers {
+		ch <- event
+	}
+}
@@ -0,0 +1,132 @@
+package addsvc
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+)
+
+func TestParseStaticDiscovery(t *testing.T) {
+	d, err := ParseStaticDiscovery("grpc_types.Hello=10.0.0.1:50051, grpc_types.Hello=10.0.0.2:50051,*=linkerd:4141")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for service, want := range map[string][]string{
+		"grpc_types.Hello":           {"10.0.0.1:50051", "10.0.0.2:50051"},
+		"grpc_types.AgentManagement": {"linkerd:4141"},
+	} {
+		instancer, err := d.Instancer(service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := []string(instancer.(sd.FixedInstancer)); !reflect.DeepEqual(want, have) {
+			t.Errorf("%s: want %v, have %v", service, want, have)
+		}
+	}
+
+	if _, err := (StaticDiscovery{}).Instancer("grpc_types.Hello"); err == nil {
+		t.Error("want an error for a service without instances")
+	}
+	if _, err := ParseStaticDiscovery("grpc_types.Hello"); err == nil {
+		t.Error("want an error for a pair without address")
+	}
+}
+
+func TestDNSSRVDiscovery(t *testing.T) {
+	d := NewDNSSRVDiscovery("_grpc._tcp.{service}.svc", time.Hour, log.NewNopLogger())
+	defer d.Stop()
+	d.lookup = func(service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_grpc._tcp.grpc-types-hello.svc" {
+			t.Errorf("unexpected SRV name %s", name)
+		}
+		return name, []*net.SRV{{Target: "hello-0.", Port: 50051}, {Target: "hello-1.", Port: 50051}}, nil
+	}
+
+	instancer, err := d.Instancer("grpc_types.Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan sd.Event, 1)
+	instancer.Register(events)
+	event := <-events
+	if want := []string{"hello-0.:50051", "hello-1.:50051"}; !reflect.DeepEqual(want, event.Instances) {
+		t.Errorf("want %v, have %v (%v)", want, event.Instances, event.Err)
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "discovery.toml")
+	write := func(content string, modTime time.Time) {
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	write(`
+		[services]
+		"grpc_types.Hello" = ["10.0.0.1:50051", "10.0.0.2:50051"]
+	`, now)
+	d, err := NewFileDiscovery(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instancer, err := d.Instancer("grpc_types.Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan sd.Event, 1)
+	instancer.Register(events)
+	defer instancer.Deregister(events)
+
+	event := <-events
+	if want := []string{"10.0.0.1:50051", "10.0.0.2:50051"}; !reflect.DeepEqual(want, event.Instances) {
+		t.Errorf("want %v, have %v", want, event.Instances)
+	}
+
+	// An instance replaced
+	write(`
+		[services]
+		"grpc_types.Hello" = ["10.0.0.1:50051", "10.0.0.3:50051"]
+	`, now.Add(time.Second))
+	if reloaded, err := d.Reload(); !reloaded || err != nil {
+		t.Fatalf("want the file reloaded, have %v %v", reloaded, err)
+	}
+	event = <-events
+	if want := []string{"10.0.0.1:50051", "10.0.0.3:50051"}; !reflect.DeepEqual(want, event.Instances) {
+		t.Errorf("want %v, have %v", want, event.Instances)
+	}
+
+	// An unchanged file is not reloaded
+	if reloaded, err := d.Reload(); reloaded || err != nil {
+		t.Errorf("want the file left alone, have %v %v", reloaded, err)
+	}
+
+	// The service removed
+	write(`
+		[services]
+		"grpc_types.World" = ["10.0.0.4:50051"]
+	`, now.Add(2*time.Second))
+	if _, err := d.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if event = <-events; event.Err == nil {
+		t.Errorf("want an error, have %v", event.Instances)
+	}
+}
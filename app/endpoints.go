@@ -11,8 +11,11 @@ import (
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/metrics"
+	"github.com/golang/protobuf/proto"
 	"github.com/newtonsystems/grpc_types/go/grpc_types"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"time"
 )
 
@@ -35,8 +38,14 @@ import (
 // It represents a single RPC method.
 
 type Endpoints struct {
-	SayHelloEndpoint endpoint.Endpoint
-	SayWorldEndpoint endpoint.Endpoint
+	SayHelloEndpoint           endpoint.Endpoint
+	SayWorldEndpoint           endpoint.Endpoint
+	GetAvailableAgentsEndpoint endpoint.Endpoint
+	GetAgentIDFromRefEndpoint  endpoint.Endpoint
+	AcceptCallEndpoint         endpoint.Endpoint
+	HeartBeatEndpoint          endpoint.Endpoint
+	AddTaskEndpoint            endpoint.Endpoint
+	PingEndpoint               endpoint.Endpoint
 }
 
 func MakeSayHelloEndpoint(connection *grpc.ClientConn) endpoint.Endpoint {
@@ -49,15 +58,171 @@ func MakeSayHelloEndpoint(connection *grpc.ClientConn) endpoint.Endpoint {
 			ctx,
 			&grpc_types.HelloRequest{Name: sayHelloReq.Name},
 		)
+		if err != nil && !isBusinessError(err) {
+			return nil, err
+		}
+
 		var msg string = ""
 		if resp != nil {
 			msg = resp.Message
 		}
 
-		return sayHelloResponse{Message: msg, Err: err}, err
+		return sayHelloResponse{Message: msg, Err: err}, nil
+	}
+}
+
+func MakeSayWorldEndpoint(connection *grpc.ClientConn) endpoint.Endpoint {
+	client := grpc_types.NewWorldClient(connection)
+
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		sayWorldReq := request.(sayWorldRequest)
+
+		resp, err := client.SayWorld(
+			ctx,
+			&grpc_types.WorldRequest{Name: sayWorldReq.Name},
+		)
+		if err != nil && !isBusinessError(err) {
+			return nil, err
+		}
+
+		var msg string = ""
+		if resp != nil {
+			msg = resp.Message
+		}
+
+		return sayWorldResponse{Message: msg, Err: err}, nil
+	}
+}
+
+// -- Agent Management Service
+//
+// The agent management messages are passed through to the backend untouched,
+// the gateway only wraps them so that they can be told apart by the transports.
+
+func MakeGetAvailableAgentsEndpoint(connection *grpc.ClientConn) endpoint.Endpoint {
+	client := grpc_types.NewAgentManagementClient(connection)
+
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getAvailableAgentsRequest)
+
+		resp, err := client.GetAvailableAgents(ctx, req.Request)
+		if err != nil && !isBusinessError(err) {
+			return nil, err
+		}
+
+		return getAvailableAgentsResponse{Response: resp, Err: err}, nil
+	}
+}
+
+func MakeGetAgentIDFromRefEndpoint(connection *grpc.ClientConn) endpoint.Endpoint {
+	client := grpc_types.NewAgentManagementClient(connection)
+
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getAgentIDFromRefRequest)
+
+		resp, err := client.GetAgentIDFromRef(ctx, req.Request)
+		if err != nil && !isBusinessError(err) {
+			return nil, err
+		}
+
+		return getAgentIDFromRefResponse{Response: resp, Err: err}, nil
+	}
+}
+
+func MakeAcceptCallEndpoint(connection *grpc.ClientConn) endpoint.Endpoint {
+	client := grpc_types.NewAgentManagementClient(connection)
+
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(acceptCallRequest)
+
+		resp, err := client.AcceptCall(ctx, req.Request)
+		if err != nil && !isBusinessError(err) {
+			return nil, err
+		}
+
+		return acceptCallResponse{Response: resp, Err: err}, nil
+	}
+}
+
+func MakeHeartBeatEndpoint(connection *grpc.ClientConn) endpoint.Endpoint {
+	client := grpc_types.NewAgentManagementClient(connection)
+
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(heartBeatRequest)
+
+		resp, err := client.HeartBeat(ctx, req.Request)
+		if err != nil && !isBusinessError(err) {
+			return nil, err
+		}
+
+		return heartBeatResponse{Response: resp, Err: err}, nil
+	}
+}
+
+func MakeAddTaskEndpoint(connection *grpc.ClientConn) endpoint.Endpoint {
+	client := grpc_types.NewAgentManagementClient(connection)
+
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(addTaskRequest)
+
+		resp, err := client.AddTask(ctx, req.Request)
+		if err != nil && !isBusinessError(err) {
+			return nil, err
+		}
+
+		return addTaskResponse{Response: resp, Err: err}, nil
 	}
 }
 
+func MakePingEndpoint(connection *grpc.ClientConn) endpoint.Endpoint {
+	client := grpc_types.NewAgentManagementClient(connection)
+
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(pingRequest)
+
+		resp, err := client.Ping(ctx, req.Request)
+		if err != nil && !isBusinessError(err) {
+			return nil, err
+		}
+
+		return pingResponse{Response: resp, Err: err}, nil
+	}
+}
+
+// Failer is implemented by every response type. Business errors, like a
+// backend answering NotFound, are bundled into the response rather than
+// returned by the endpoint, so that they are not counted by middlewares that
+// check errors, like circuit breakers. Response encoders check Failed and
+// encode the error instead of the response.
+type Failer interface {
+	Failed() error
+}
+
+// protoResponder is implemented by the responses wrapping the protobuf reply
+// of a backend. EncodeHTTPGenericResponse encodes the reply itself, using the
+// protobuf JSON mapping like the routes of the route table.
+type protoResponder interface {
+	protoMessage() proto.Message
+}
+
+// isBusinessError reports whether a backend error is about the request itself
+// rather than the backend or the connection to it. Business errors are
+// bundled into the response, any other error is returned by the endpoint.
+func isBusinessError(err error) bool {
+	s, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+
+	switch s.Code() {
+	case codes.InvalidArgument, codes.NotFound, codes.AlreadyExists,
+		codes.PermissionDenied, codes.Unauthenticated, codes.FailedPrecondition,
+		codes.Aborted, codes.OutOfRange:
+		return true
+	}
+	return false
+}
+
 // EndpointInstrumentingMiddleware returns an endpoint middleware that records
 // the duration of each invocation to the passed histogram. The middleware adds
 // a single field: "success", which is "true" if no error is returned, and
@@ -101,11 +266,94 @@ type sayHelloRequest struct{ Name string }
 
 type sayHelloResponse struct {
 	Message string
-	Err     error
+	Err     error `json:"-"`
 }
 
+func (r sayHelloResponse) Failed() error { return r.Err }
+
 type sayWorldRequest struct{ Name string }
 
 type sayWorldResponse struct {
 	Message string
+	Err     error `json:"-"`
+}
+
+func (r sayWorldResponse) Failed() error { return r.Err }
+
+type getAvailableAgentsRequest struct {
+	Request *grpc_types.GetAvailableAgentsRequest
+}
+
+type getAvailableAgentsResponse struct {
+	Response *grpc_types.GetAvailableAgentsResponse
+	Err      error `json:"-"`
+}
+
+func (r getAvailableAgentsResponse) Failed() error { return r.Err }
+
+func (r getAvailableAgentsResponse) protoMessage() proto.Message { return r.Response }
+
+type getAgentIDFromRefRequest struct {
+	Request *grpc_types.GetAgentIDFromRefRequest
 }
+
+type getAgentIDFromRefResponse struct {
+	Response *grpc_types.GetAgentIDFromRefResponse
+	Err      error `json:"-"`
+}
+
+func (r getAgentIDFromRefResponse) Failed() error { return r.Err }
+
+func (r getAgentIDFromRefResponse) protoMessage() proto.Message { return r.Response }
+
+type acceptCallRequest struct {
+	Request *grpc_types.AcceptCallRequest
+}
+
+type acceptCallResponse struct {
+	Response *grpc_types.AcceptCallResponse
+	Err      error `json:"-"`
+}
+
+func (r acceptCallResponse) Failed() error { return r.Err }
+
+func (r acceptCallResponse) protoMessage() proto.Message { return r.Response }
+
+type heartBeatRequest struct {
+	Request *grpc_types.HeartBeatRequest
+}
+
+type heartBeatResponse struct {
+	Response *grpc_types.HeartBeatResponse
+	Err      error `json:"-"`
+}
+
+func (r heartBeatResponse) Failed() error { return r.Err }
+
+func (r heartBeatResponse) protoMessage() proto.Message { return r.Response }
+
+type addTaskRequest struct {
+	Request *grpc_types.AddTaskRequest
+}
+
+type addTaskResponse struct {
+	Response *grpc_types.AddTaskResponse
+	Err      error `json:"-"`
+}
+
+func (r addTaskResponse) Failed() error { return r.Err }
+
+func (r addTaskResponse) protoMessage() proto.Message { return r.Response }
+
+type pingRequest struct {
+	Request *grpc_types.PingRequest
+}
+
+type pingResponse struct {
+	Response *grpc_types.PingResponse
+	Err      error `json:"-"`
+}
+
+func (r pingResponse) Failed() error { return r.Err }
+
+func (r pingResponse) protoMessage() proto.Message { return r.Response }
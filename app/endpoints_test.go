@@ -0,0 +1,113 @@
+package addsvc
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/newtonsystems/grpc_types/go/grpc_types"
+	oldcontext "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeHelloServer answers SayHello with err if set, otherwise with a greeting.
+type fakeHelloServer struct {
+	err error
+}
+
+func (s fakeHelloServer) SayHello(_ oldcontext.Context, req *grpc_types.HelloRequest) (*grpc_types.HelloResponse, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &grpc_types.HelloResponse{Message: "Hello " + req.Name}, nil
+}
+
+// dialFakeHelloServer starts a fake Hello backend and returns a connection to
+// it and a function stopping both.
+func dialFakeHelloServer(t *testing.T, srv grpc_types.HelloServer) (*grpc.ClientConn, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := grpc.NewServer()
+	grpc_types.RegisterHelloServer(s, srv)
+	go s.Serve(ln)
+
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, func() {
+		conn.Close()
+		s.Stop()
+	}
+}
+
+func TestSayHelloEndpointSuccess(t *testing.T) {
+	conn, stop := dialFakeHelloServer(t, fakeHelloServer{})
+	defer stop()
+
+	resp, err := MakeSayHelloEndpoint(conn)(context.Background(), sayHelloRequest{Name: "James"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r := resp.(sayHelloResponse)
+	if r.Failed() != nil {
+		t.Fatalf("unexpected business error: %v", r.Failed())
+	}
+	if want, have := "Hello James", r.Message; want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
+
+func TestSayHelloEndpointBusinessError(t *testing.T) {
+	conn, stop := dialFakeHelloServer(t, fakeHelloServer{err: status.Error(codes.NotFound, "no such person")})
+	defer stop()
+
+	resp, err := MakeSayHelloEndpoint(conn)(context.Background(), sayHelloRequest{Name: "James"})
+	if err != nil {
+		t.Fatalf("business errors must not be returned by the endpoint, have %v", err)
+	}
+
+	failed := resp.(Failer).Failed()
+	if want, have := codes.NotFound, grpc.Code(failed); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+}
+
+func TestSayHelloEndpointTransportError(t *testing.T) {
+	conn, stop := dialFakeHelloServer(t, fakeHelloServer{err: status.Error(codes.Unavailable, "backend down")})
+	defer stop()
+
+	resp, err := MakeSayHelloEndpoint(conn)(context.Background(), sayHelloRequest{Name: "James"})
+	if want, have := codes.Unavailable, grpc.Code(err); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+	if resp != nil {
+		t.Errorf("want no response, have %v", resp)
+	}
+}
+
+func TestIsBusinessError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{status.Error(codes.InvalidArgument, ""), true},
+		{status.Error(codes.NotFound, ""), true},
+		{status.Error(codes.PermissionDenied, ""), true},
+		{status.Error(codes.Unavailable, ""), false},
+		{status.Error(codes.DeadlineExceeded, ""), false},
+		{status.Error(codes.Internal, ""), false},
+		{context.Canceled, false},
+	} {
+		if have := isBusinessError(tc.err); tc.want != have {
+			t.Errorf("%v: want %v, have %v", tc.err, tc.want, have)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package addsvc
+
+// This file provides the liveness and readiness of the gateway. The gateway
+// is alive as long as it serves, and ready when its dependencies are: the
+// backends are connected and the optional active probes, like a Ping of the
+// agent management service, succeed. Readiness is served over HTTP at
+// /readyz with the detail of each dependency, and by the grpc.health.v1
+// Health service.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/newtonsystems/grpc_types/go/grpc_types"
+	oldcontext "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// HealthCheck checks a dependency of the gateway. It returns the detail of
+// the dependency for the readiness report, and an error if the dependency is
+// not ready.
+type HealthCheck func(ctx context.Context) (detail interface{}, err error)
+
+// DependencyHealth is the outcome of the last check of a dependency.
+type DependencyHealth struct {
+	Ready   bool        `json:"ready"`
+	Error   string      `json:"error,omitempty"`
+	Detail  interface{} `json:"detail,omitempty"`
+	Checked *time.Time  `json:"checked,omitempty"`
+}
+
+// Health checks the dependencies of the gateway, serving the outcome of the
+// last checks. The gateway is ready when every dependency is, and not before
+// they are first checked. It is safe for concurrent use.
+type Health struct {
+	timeout time.Duration
+	logger  log.Logger
+
+	mtx     sync.Mutex
+	checks  map[string]HealthCheck
+	results map[string]DependencyHealth
+}
+
+// NewHealth returns a Health without dependencies, each check being given at
+// most timeout.
+func NewHealth(timeout time.Duration, logger log.Logger) *Health {
+	return &Health{
+		timeout: timeout,
+		logger:  logger,
+		checks:  map[string]HealthCheck{},
+		results: map[string]DependencyHealth{},
+	}
+}
+
+// Add adds the dependency name, checked by check. The dependency is also
+// served as a service of the gRPC Health service.
+func (h *Health) Add(name string, check HealthCheck) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.checks[name] = check
+	h.results[name] = DependencyHealth{Error: "not checked yet"}
+}
+
+// Check checks every dependency concurrently, and returns whether the
+// gateway is ready.
+func (h *Health) Check(ctx context.Context) bool {
+	h.mtx.Lock()
+	checks := make(map[string]HealthCheck, len(h.checks))
+	for name, check := range h.checks {
+		checks[name] = check
+	}
+	h.mtx.Unlock()
+
+	results := make(map[string]DependencyHealth, len(checks))
+	var wg sync.WaitGroup
+	var resultsMtx sync.Mutex
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check HealthCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, h.timeout)
+			defer cancel()
+
+			detail, err := check(ctx)
+			checked := time.Now()
+			result := DependencyHealth{Ready: err == nil, Detail: detail, Checked: &checked}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			resultsMtx.Lock()
+			results[name] = result
+			resultsMtx.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	ready := true
+	for name, result := range results {
+		if previous := h.results[name]; previous.Ready != result.Ready {
+			if result.Ready {
+				h.logger.Log("level", "info", "msg", "dependency ready", "dependency", name)
+			} else if previous.Checked != nil {
+				h.logger.Log("level", "warn", "msg", "dependency not ready", "dependency", name, "err", result.Error)
+			}
+		}
+		h.results[name] = result
+		ready = ready && result.Ready
+	}
+	return ready
+}
+
+// Run checks the dependencies at once, then every interval until ctx is
+// done.
+func (h *Health) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		h.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Ready returns whether the gateway is ready, and the outcome of the last
+// check of each dependency.
+func (h *Health) Ready() (bool, map[string]DependencyHealth) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	ready := true
+	results := make(map[string]DependencyHealth, len(h.results))
+	for name, result := range h.results {
+		results[name] = result
+		ready = ready && result.Ready
+	}
+	return ready, results
+}
+
+// GRPCServer returns the grpc.health.v1 Health service serving the
+// readiness of the gateway as the "" service, and the one of each dependency
+// as the service named after it.
+func (h *Health) GRPCServer() healthpb.HealthServer {
+	return healthServer{h}
+}
+
+type healthServer struct {
+	health *Health
+}
+
+// Check implements healthpb.HealthServer.
+func (s healthServer) Check(ctx oldcontext.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	ready, dependencies := s.health.Ready()
+	if req.Service != "" {
+		dependency, ok := dependencies[req.Service]
+		if !ok {
+			return nil, grpc.Errorf(codes.NotFound, "unknown service %s", req.Service)
+		}
+		ready = dependency.Ready
+	}
+	return &healthpb.HealthCheckResponse{Status: servingStatus(ready)}, nil
+}
+
+func servingStatus(ready bool) healthpb.HealthCheckResponse_ServingStatus {
+	if ready {
+		return healthpb.HealthCheckResponse_SERVING
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING
+}
+
+// MakeLivenessHandler returns the /healthz handler, answering 200 as long as
+// the gateway serves.
+func MakeLivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+}
+
+// MakeReadinessHandler returns the /readyz handler, answering 200 if the
+// gateway is ready and 503 otherwise, with the detail of each dependency.
+func MakeReadinessHandler(h *Health) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ready, dependencies := h.Ready()
+		report := struct {
+			Status       string                      `json:"status"`
+			Dependencies map[string]DependencyHealth `json:"dependencies"`
+		}{"ready", dependencies}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if !ready {
+			report.Status = "not_ready"
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+// InstanceHealth is the readiness detail of a backend instance.
+type InstanceHealth struct {
+	Addr        string `json:"addr"`
+	State       string `json:"state"`
+	Ejected     bool   `json:"ejected,omitempty"`
+	Outstanding int64  `json:"outstanding"`
+}
+
+// BackendHealthCheck returns a HealthCheck of backend, ready when one of its
+// instances is connected. The detail lists the instances.
+func BackendHealthCheck(backend *Backend) HealthCheck {
+	return func(ctx context.Context) (interface{}, error) {
+		backend.mtx.Lock()
+		now := backend.now()
+		instances := make([]InstanceHealth, 0, len(backend.instances))
+		for _, instance := range backend.instances {
+			instances = append(instances, InstanceHealth{
+				Addr:        instance.addr,
+				State:       instance.State().String(),
+				Ejected:     now.Before(instance.ejectedUntil),
+				Outstanding: instance.Outstanding(),
+			})
+		}
+		backend.mtx.Unlock()
+		sort.Slice(instances, func(i, j int) bool { return instances[i].Addr < instances[j].Addr })
+
+		return instances, backend.Ready()
+	}
+}
+
+// PingHealthCheck returns a HealthCheck calling the Ping endpoint e i.e.
+// BackendEndpoint(backend, MakePingEndpoint). The detail is the latency of
+// the call.
+func PingHealthCheck(e endpoint.Endpoint) HealthCheck {
+	return func(ctx context.Context) (interface{}, error) {
+		begin := time.Now()
+		response, err := e(ctx, pingRequest{Request: &grpc_types.PingRequest{}})
+		latency := map[string]string{"latency": time.Since(begin).String()}
+		if err != nil {
+			return latency, err
+		}
+		if f, ok := response.(Failer); ok && f.Failed() != nil {
+			return latency, fmt.Errorf("ping: %v", f.Failed())
+		}
+		return latency, nil
+	}
+}
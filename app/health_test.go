@@ -0,0 +1,91 @@
+package addsvc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/newtonsystems/grpc_types/go/grpc_types"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestHealthReadiness(t *testing.T) {
+	h := NewHealth(time.Second, log.NewNopLogger())
+	h.Add("grpc_types.Hello", func(context.Context) (interface{}, error) {
+		return []InstanceHealth{{Addr: "10.0.0.1:50051", State: "READY"}}, nil
+	})
+	var pingErr error
+	h.Add("ping", func(context.Context) (interface{}, error) {
+		return nil, pingErr
+	})
+
+	serving := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := h.GRPCServer().Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Status
+	}
+	readyz := func() (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		MakeReadinessHandler(h).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		var report map[string]interface{}
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, report
+	}
+
+	// Not ready until checked
+	if code, report := readyz(); code != http.StatusServiceUnavailable || report["status"] != "not_ready" {
+		t.Fatalf("want 503 not_ready, have %d %v", code, report)
+	}
+	if status := serving(""); status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("want NOT_SERVING, have %s", status)
+	}
+
+	// A failing dependency keeps the gateway not ready
+	pingErr = errors.New("connection refused")
+	if h.Check(context.Background()) {
+		t.Fatal("want not ready")
+	}
+	if status := serving("grpc_types.Hello"); status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("want the backend SERVING, have %s", status)
+	}
+	if status := serving("ping"); status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("want the probe NOT_SERVING, have %s", status)
+	}
+	_, report := readyz()
+	ping := report["dependencies"].(map[string]interface{})["ping"].(map[string]interface{})
+	if ping["ready"] != false || ping["error"] != "connection refused" {
+		t.Errorf("want the probe error reported, have %v", ping)
+	}
+
+	pingErr = nil
+	if !h.Check(context.Background()) {
+		t.Fatal("want ready")
+	}
+	if code, report := readyz(); code != http.StatusOK || report["status"] != "ready" {
+		t.Fatalf("want 200 ready, have %d %v", code, report)
+	}
+	if status := serving(""); status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("want SERVING, have %s", status)
+	}
+}
+
+func TestPingHealthCheck(t *testing.T) {
+	check := PingHealthCheck(func(_ context.Context, request interface{}) (interface{}, error) {
+		if _, ok := request.(pingRequest); !ok {
+			t.Fatalf("want a ping request, have %T", request)
+		}
+		return pingResponse{Response: &grpc_types.PingResponse{}, Err: errors.New("agents unavailable")}, nil
+	})
+	if _, err := check(context.Background()); err == nil {
+		t.Error("want the failed ping reported")
+	}
+}
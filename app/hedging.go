@@ -0,0 +1,99 @@
+package addsvc
+
+// This file provides hedged requests: when a call has not answered after a
+// delay, typically the 95th percentile latency of its method, a second
+// identical call is sent and the first successful response is used. This
+// trims the tail latency caused by a single slow backend replica, for a few
+// percent of extra load. Only idempotent methods can be hedged.
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+)
+
+// HedgeDelay returns how long to wait before hedging a call, and false if
+// the call should not be hedged.
+type HedgeDelay func() (time.Duration, bool)
+
+// FixedHedgeDelay always hedges after delay.
+func FixedHedgeDelay(delay time.Duration) HedgeDelay {
+	return func() (time.Duration, bool) {
+		return delay, true
+	}
+}
+
+// QuantileHedgeDelay hedges after the q quantile (i.e. 0.95) of the recent
+// latencies of method, and not at all until enough calls were observed. The
+// delay is never shorter than min.
+func QuantileHedgeDelay(latencies *LatencyTracker, method string, q float64, min time.Duration) HedgeDelay {
+	return func() (time.Duration, bool) {
+		delay, ok := latencies.Quantile(method, q)
+		if delay < min {
+			delay = min
+		}
+		return delay, ok
+	}
+}
+
+type hedgeResult struct {
+	response interface{}
+	err      error
+	hedge    bool
+}
+
+// HedgingMiddleware returns an endpoint middleware sending a second call
+// when the first one has not answered after delay. The first successful
+// response is returned and the other call cancelled; if both fail, the last
+// error is returned. A call failing before the delay is not hedged, failures
+// are for the retry policy to handle. Hedged calls are counted in hedges,
+// labelled by the winner: "original" or "hedge".
+func HedgingMiddleware(delay HedgeDelay, hedges metrics.Counter) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			d, ok := delay()
+			if !ok {
+				return next(ctx, request)
+			}
+
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			results := make(chan hedgeResult, 2)
+			call := func(hedge bool) {
+				response, err := next(ctx, request)
+				results <- hedgeResult{response: response, err: err, hedge: hedge}
+			}
+			go call(false)
+
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+
+			select {
+			case r := <-results:
+				return r.response, r.err
+			case <-timer.C:
+				go call(true)
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+
+			var last hedgeResult
+			for i := 0; i < 2; i++ {
+				last = <-results
+				if last.err == nil {
+					winner := "original"
+					if last.hedge {
+						winner = "hedge"
+					}
+					hedges.With("winner", winner).Add(1)
+					return last.response, nil
+				}
+			}
+			hedges.With("winner", "none").Add(1)
+			return last.response, last.err
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package addsvc
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/discard"
+)
+
+func TestHedgingMiddleware(t *testing.T) {
+	var calls int32
+	var cancelled int32
+	e := HedgingMiddleware(FixedHedgeDelay(10*time.Millisecond), discard.NewCounter())(func(ctx context.Context, _ interface{}) (interface{}, error) {
+		// The original call is slow, the hedge fast
+		delay := 10 * time.Millisecond
+		if atomic.AddInt32(&calls, 1) == 1 {
+			delay = time.Second
+		}
+		select {
+		case <-time.After(delay):
+			return "ok", nil
+		case <-ctx.Done():
+			atomic.AddInt32(&cancelled, 1)
+			return nil, ctx.Err()
+		}
+	})
+
+	begin := time.Now()
+	response, err := e(context.Background(), nil)
+	if err != nil || response != "ok" {
+		t.Fatalf("want the hedge response, have %v, %v", response, err)
+	}
+	if elapsed := time.Since(begin); elapsed > 500*time.Millisecond {
+		t.Errorf("want the hedge to answer first, took %v", elapsed)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt32(&calls) != 2 || atomic.LoadInt32(&cancelled) != 1 {
+		t.Errorf("want 2 calls and the original one cancelled, have %d calls and %d cancelled", calls, cancelled)
+	}
+}
+
+func TestHedgingMiddlewareFastFailure(t *testing.T) {
+	calls := 0
+	failure := errors.New("failed")
+	e := HedgingMiddleware(FixedHedgeDelay(time.Second), discard.NewCounter())(func(context.Context, interface{}) (interface{}, error) {
+		calls++
+		return nil, failure
+	})
+	if _, err := e(context.Background(), nil); err != failure || calls != 1 {
+		t.Errorf("want a fast failure not to be hedged, have %v after %d calls", err, calls)
+	}
+}
+
+func TestQuantileHedgeDelay(t *testing.T) {
+	latencies := NewLatencyTracker(discard.NewHistogram(), 100)
+	delay := QuantileHedgeDelay(latencies, "GetAvailableAgents", 0.95, time.Millisecond)
+	if _, ok := delay(); ok {
+		t.Error("want no hedging before enough calls were observed")
+	}
+
+	h := latencies.With("method", "GetAvailableAgents")
+	for i := 1; i <= 100; i++ {
+		h.With("success", "true").Observe(float64(i) / 1000)
+		h.With("success", "false").Observe(10)
+	}
+	d, ok := delay()
+	if !ok || d != 96*time.Millisecond {
+		t.Errorf("want a 96ms delay, have %v %v", d, ok)
+	}
+}
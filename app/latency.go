@@ -0,0 +1,153 @@
+package addsvc
+
+// This file provides a histogram keeping the recent latencies of each method
+// in process, so that middlewares can adapt to them, while passing every
+// observation on to the exported histogram.
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// LatencyTracker is a metrics.Histogram recording the latencies, in seconds,
+// of the successful calls of each method. It must be labelled with "method"
+// and "success" like the histogram of EndpointInstrumentingMiddleware.
+type LatencyTracker struct {
+	next        metrics.Histogram
+	labelValues []string
+	windows     *latencyWindows
+}
+
+// NewLatencyTracker returns a LatencyTracker keeping the last size latencies
+// of each method and observing them in next as well.
+func NewLatencyTracker(next metrics.Histogram, size int) *LatencyTracker {
+	if size < minLatencySamples {
+		size = minLatencySamples
+	}
+	return &LatencyTracker{
+		next: next,
+		windows: &latencyWindows{
+			size:          size,
+			methods:       map[string]*latencyWindow{},
+			subscriptions: map[string][]func(time.Duration){},
+		},
+	}
+}
+
+// With implements metrics.Histogram.
+func (t *LatencyTracker) With(labelValues ...string) metrics.Histogram {
+	return &LatencyTracker{
+		next:        t.next.With(labelValues...),
+		labelValues: append(append([]string{}, t.labelValues...), labelValues...),
+		windows:     t.windows,
+	}
+}
+
+// Observe implements metrics.Histogram.
+func (t *LatencyTracker) Observe(value float64) {
+	t.next.Observe(value)
+
+	var method, success string
+	for i := 0; i+1 < len(t.labelValues); i += 2 {
+		switch t.labelValues[i] {
+		case "method":
+			method = t.labelValues[i+1]
+		case "success":
+			success = t.labelValues[i+1]
+		}
+	}
+	if method != "" && success == "true" {
+		d := time.Duration(value * float64(time.Second))
+		t.windows.get(method).add(d)
+		for _, fn := range t.windows.subscribers(method) {
+			fn(d)
+		}
+	}
+}
+
+// Subscribe calls fn with every latency recorded for method.
+func (t *LatencyTracker) Subscribe(method string, fn func(time.Duration)) {
+	t.windows.mtx.Lock()
+	defer t.windows.mtx.Unlock()
+	t.windows.subscriptions[method] = append(t.windows.subscriptions[method], fn)
+}
+
+// Quantile returns the q quantile (i.e. 0.95) of the recent latencies of
+// method. It returns false until enough calls were observed.
+func (t *LatencyTracker) Quantile(method string, q float64) (time.Duration, bool) {
+	return t.windows.get(method).quantile(q)
+}
+
+type latencyWindows struct {
+	size          int
+	mtx           sync.Mutex
+	methods       map[string]*latencyWindow
+	subscriptions map[string][]func(time.Duration)
+}
+
+func (w *latencyWindows) subscribers(method string) []func(time.Duration) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.subscriptions[method]
+}
+
+func (w *latencyWindows) get(method string) *latencyWindow {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	lw, ok := w.methods[method]
+	if !ok {
+		lw = &latencyWindow{samples: make([]time.Duration, 0, w.size)}
+		w.methods[method] = lw
+	}
+	return lw
+}
+
+// minLatencySamples is the number of samples below which the statistics of a
+// window are not considered meaningful.
+const minLatencySamples = 20
+
+// latencyWindow is a ring buffer of samples. The sorted samples are cached
+// and only refreshed every so often, quantiles being needed on every call.
+type latencyWindow struct {
+	mtx     sync.Mutex
+	samples []time.Duration
+	next    int
+	sorted  []time.Duration
+	stale   int
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if len(w.samples) < cap(w.samples) {
+		w.samples = append(w.samples, d)
+	} else {
+		w.samples[w.next] = d
+		w.next = (w.next + 1) % len(w.samples)
+	}
+	w.stale++
+}
+
+func (w *latencyWindow) quantile(q float64) (time.Duration, bool) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if len(w.samples) < minLatencySamples {
+		return 0, false
+	}
+	if w.sorted == nil || w.stale > len(w.samples)/10 {
+		w.sorted = append(w.sorted[:0], w.samples...)
+		sort.Slice(w.sorted, func(i, j int) bool { return w.sorted[i] < w.sorted[j] })
+		w.stale = 0
+	}
+	i := int(q * float64(len(w.sorted)))
+	if i >= len(w.sorted) {
+		i = len(w.sorted) - 1
+	}
+	return w.sorted[i], true
+}
@@ -0,0 +1,253 @@
+package addsvc
+
+// This file provides token bucket rate limiting of the gateway methods, per
+// client and globally. Clients are identified by their API key, their JWT
+// subject or, for anonymous callers, their remote address.
+
+import (
+	"context"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Limit is a token bucket refilled with Rate tokens per second and holding
+// at most Burst tokens. A zero Rate means no limit.
+type Limit struct {
+	Rate  float64 `toml:"rate"`
+	Burst int     `toml:"burst"`
+}
+
+// RateLimitConfig holds the rate limits of the gateway, loaded from a TOML
+// file i.e.
+//
+//	# Shared by every client and method
+//	[global]
+//	rate = 500
+//	burst = 1000
+//
+//	# Per client and method, for methods without their own limit
+//	[client]
+//	rate = 10
+//	burst = 20
+//
+//	[methods.AddTask]
+//	rate = 1
+//	burst = 5
+//
+//	# Per client and method, for API keys of the tier
+//	[tiers.premium]
+//	rate = 100
+//	burst = 200
+type RateLimitConfig struct {
+	Global  Limit            `toml:"global"`
+	Client  Limit            `toml:"client"`
+	Methods map[string]Limit `toml:"methods"`
+	Tiers   map[string]Limit `toml:"tiers"`
+}
+
+// LoadRateLimitConfig reads a TOML rate limit file.
+func LoadRateLimitConfig(filename string) (RateLimitConfig, error) {
+	var config RateLimitConfig
+	_, err := toml.DecodeFile(filename, &config)
+	return config, err
+}
+
+// clientLimit returns the limit of a client calling method. Method limits
+// take precedence over the tier of the client's API key.
+func (c RateLimitConfig) clientLimit(method, tier string) Limit {
+	if limit, ok := c.Methods[method]; ok {
+		return limit
+	}
+	if limit, ok := c.Tiers[tier]; ok && tier != "" {
+		return limit
+	}
+	return c.Client
+}
+
+// tokenBucket is not safe for concurrent use.
+type tokenBucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit Limit, now time.Time) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: float64(limit.burst()), last: now}
+}
+
+func (l Limit) burst() int {
+	if l.Burst < 1 {
+		return 1
+	}
+	return l.Burst
+}
+
+// take removes a token from the bucket. If it is empty, it returns false and
+// how long until a token is available.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// give puts back a token taken by take.
+func (b *tokenBucket) give() {
+	b.tokens = math.Min(b.tokens+1, float64(b.limit.burst()))
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.tokens+elapsed.Seconds()*b.limit.Rate, float64(b.limit.burst()))
+		b.last = now
+	}
+}
+
+// full reports whether the bucket is full at now, in which case it holds no
+// state worth keeping.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= float64(b.limit.burst())
+}
+
+type clientBucketKey struct {
+	method string
+	client string
+}
+
+// RateLimiter holds the token buckets of every client and the global one.
+// Idle client buckets are dropped periodically.
+type RateLimiter struct {
+	config RateLimitConfig
+	now    func() time.Time
+
+	mtx       sync.Mutex
+	global    *tokenBucket
+	clients   map[clientBucketKey]*tokenBucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter returns a RateLimiter enforcing config.
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		config:  config,
+		now:     time.Now,
+		clients: map[clientBucketKey]*tokenBucket{},
+	}
+}
+
+// Allow takes a token from the bucket of client for method and from the
+// global bucket. If either is empty, it returns false, the scope of the
+// empty bucket ("client" or "global") and how long to wait before retrying.
+func (l *RateLimiter) Allow(method, client, tier string) (bool, string, time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) > time.Minute {
+		for key, b := range l.clients {
+			if b.full(now) {
+				delete(l.clients, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	var bucket *tokenBucket
+	if limit := l.config.clientLimit(method, tier); limit.Rate > 0 {
+		key := clientBucketKey{method: method, client: client}
+		bucket = l.clients[key]
+		if bucket == nil || bucket.limit != limit {
+			bucket = newTokenBucket(limit, now)
+			l.clients[key] = bucket
+		}
+		if ok, retryAfter := bucket.take(now); !ok {
+			return false, "client", retryAfter
+		}
+	}
+
+	if l.global == nil && l.config.Global.Rate > 0 {
+		l.global = newTokenBucket(l.config.Global, now)
+	}
+	if l.global != nil {
+		if ok, retryAfter := l.global.take(now); !ok {
+			if bucket != nil {
+				bucket.give()
+			}
+			return false, "global", retryAfter
+		}
+	}
+
+	return true, "", 0
+}
+
+// RateLimitingMiddleware returns an endpoint middleware rejecting the calls
+// to method exceeding the limits of limiter with codes.ResourceExhausted (429
+// over HTTP). The error carries a google.rpc.RetryInfo detail, served as the
+// Retry-After header over HTTP. Rejected calls are counted in throttled,
+// labelled by scope. It must be wrapped by the authentication middleware so
+// that clients are identified by their credentials.
+func RateLimitingMiddleware(limiter *RateLimiter, method string, throttled metrics.Counter) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			client, tier := ClientIdentity(ctx)
+			if ok, scope, retryAfter := limiter.Allow(method, client, tier); !ok {
+				throttled.With("scope", scope).Add(1)
+				return nil, rateLimitError(retryAfter)
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// ClientIdentity returns the identity of the caller: the owner of its API
+// key, its JWT subject or, failing that, its remote IP address. The rate tier
+// of the API key is returned as well.
+func ClientIdentity(ctx context.Context) (client, tier string) {
+	if key, ok := APIKeyFromContext(ctx); ok {
+		return "apikey:" + key.Owner, key.RateTier
+	}
+	if claims, ok := ClaimsFromContext(ctx); ok {
+		if sub, ok := claims["sub"].(string); ok && sub != "" {
+			return "sub:" + sub, ""
+		}
+	}
+
+	return "addr:" + remoteHost(ctx), ""
+}
+
+// remoteHost returns the remote host of the HTTP or gRPC request in ctx.
+func remoteHost(ctx context.Context) string {
+	var addr string
+	if remoteAddr, ok := ctx.Value(httptransport.ContextKeyRequestRemoteAddr).(string); ok {
+		addr = remoteAddr
+	} else if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return addr
+}
+
+func rateLimitError(retryAfter time.Duration) error {
+	s := status.New(codes.ResourceExhausted, "rate limit exceeded")
+	if detailed, err := s.WithDetails(&errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(retryAfter)}); err == nil {
+		s = detailed
+	}
+	return s.Err()
+}
@@ -0,0 +1,219 @@
+package addsvc
+
+// This file provides a RateLimitStore backed by Redis, or any server speaking
+// the Redis protocol (RESP), so that quotas are shared by every gateway
+// replica. It only needs the INCR, PEXPIRE and GET commands.
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// RedisRateLimitStore is a RateLimitStore keeping a counter per key and fixed
+// window in Redis. Counters expire once they can no longer be the previous
+// window of a request.
+type RedisRateLimitStore struct {
+	addr    string
+	timeout time.Duration
+	idle    chan *redisConn
+}
+
+// NewRedisRateLimitStore returns a RedisRateLimitStore for the server at addr
+// keeping at most poolSize idle connections. Commands taking longer than
+// timeout, or than the context deadline, fail.
+func NewRedisRateLimitStore(addr string, poolSize int, timeout time.Duration) *RedisRateLimitStore {
+	return &RedisRateLimitStore{
+		addr:    addr,
+		timeout: timeout,
+		idle:    make(chan *redisConn, poolSize),
+	}
+}
+
+// Incr implements RateLimitStore.
+func (s *RedisRateLimitStore) Incr(ctx context.Context, key string, window time.Duration, start time.Time) (int64, int64, error) {
+	current := redisWindowKey(key, start)
+	previous := redisWindowKey(key, start.Add(-window))
+	ttl := strconv.FormatInt(int64(2*window/time.Millisecond), 10)
+
+	replies, err := s.do(ctx,
+		[]string{"INCR", current},
+		[]string{"PEXPIRE", current, ttl},
+		[]string{"GET", previous},
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	n, ok := replies[0].(int64)
+	if !ok {
+		return 0, 0, fmt.Errorf("redis: unexpected INCR reply %v", replies[0])
+	}
+	var prev int64
+	switch v := replies[2].(type) {
+	case nil:
+	case []byte:
+		if prev, err = strconv.ParseInt(string(v), 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("redis: unexpected GET reply %q", v)
+		}
+	default:
+		return 0, 0, fmt.Errorf("redis: unexpected GET reply %v", v)
+	}
+	return n, prev, nil
+}
+
+// Close closes the idle connections.
+func (s *RedisRateLimitStore) Close() error {
+	for {
+		select {
+		case c := <-s.idle:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func redisWindowKey(key string, start time.Time) string {
+	return "ratelimit:" + key + ":" + strconv.FormatInt(start.UnixNano()/int64(time.Millisecond), 10)
+}
+
+// do sends the commands in a single pipeline and returns their replies. An
+// error reply to any command is returned as the error.
+func (s *RedisRateLimitStore) do(ctx context.Context, commands ...[]string) ([]interface{}, error) {
+	c, err := s.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(s.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.SetDeadline(deadline)
+
+	replies, err := c.pipeline(commands)
+	if err != nil {
+		// The connection state is unknown, don't reuse it
+		c.Close()
+		return nil, err
+	}
+	s.put(c)
+
+	for _, reply := range replies {
+		if err, ok := reply.(redisError); ok {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+func (s *RedisRateLimitStore) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+	}
+
+	dialer := net.Dialer{Timeout: s.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConn{Conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}, nil
+}
+
+func (s *RedisRateLimitStore) put(c *redisConn) {
+	select {
+	case s.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+// redisConn is a connection speaking RESP.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func (c *redisConn) pipeline(commands [][]string) ([]interface{}, error) {
+	for _, args := range commands {
+		fmt.Fprintf(c.w, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]interface{}, len(commands))
+	for i := range commands {
+		reply, err := readRESP(c.r)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// readRESP reads a single reply. Simple strings are returned as string,
+// errors as redisError, integers as int64, bulk strings as []byte, arrays as
+// []interface{} and null replies as nil.
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return redisError(line), nil
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		array := make([]interface{}, n)
+		for i := range array {
+			if array[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
@@ -0,0 +1,198 @@
+package addsvc
+
+// This file provides cluster-wide request quotas per tenant. Unlike the
+// RateLimiter token buckets, which are local to a gateway replica, the quota
+// counters live in a RateLimitStore shared by every replica. Counts are
+// estimated with sliding windows: the count of the previous fixed window is
+// weighted by how much of it still overlaps the sliding window.
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+)
+
+// RateLimitStore holds request counters per key and fixed window.
+type RateLimitStore interface {
+	// Incr adds a request to the window of key starting at start, and returns
+	// the request counts of that window and of the window before it.
+	Incr(ctx context.Context, key string, window time.Duration, start time.Time) (current, previous int64, err error)
+}
+
+// MemoryRateLimitStore is a RateLimitStore local to the process, for single
+// replica deployments and tests. Counters are dropped once they can no longer
+// be the previous window of a request.
+type MemoryRateLimitStore struct {
+	mtx       sync.Mutex
+	counters  map[string]*windowCounter
+	lastSweep time.Time
+}
+
+type windowCounter struct {
+	start             time.Time
+	window            time.Duration
+	current, previous int64
+}
+
+// NewMemoryRateLimitStore returns an empty MemoryRateLimitStore.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{counters: map[string]*windowCounter{}}
+}
+
+// Incr implements RateLimitStore.
+func (s *MemoryRateLimitStore) Incr(_ context.Context, key string, window time.Duration, start time.Time) (int64, int64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if start.Sub(s.lastSweep) > time.Minute {
+		for k, c := range s.counters {
+			if start.Sub(c.start) > c.window {
+				delete(s.counters, k)
+			}
+		}
+		s.lastSweep = start
+	}
+
+	c, ok := s.counters[key]
+	switch {
+	case !ok:
+		c = &windowCounter{start: start, window: window}
+		s.counters[key] = c
+	case start.Equal(c.start.Add(window)):
+		c.start, c.previous, c.current = start, c.current, 0
+	case !start.Equal(c.start):
+		c.start, c.previous, c.current = start, 0, 0
+	}
+	c.current++
+	return c.current, c.previous, nil
+}
+
+// Quota is the maximum number of requests allowed in any Window.
+type Quota struct {
+	Limit  int64    `toml:"limit"`
+	Window duration `toml:"window"`
+}
+
+// duration is a time.Duration decoded from strings such as "1m".
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	*d = duration(v)
+	return err
+}
+
+// QuotaConfig holds the quotas of the tenants, loaded from a TOML file i.e.
+//
+//	[default]
+//	limit = 6000
+//	window = "1m"
+//
+//	[tenants.acme]
+//	limit = 60000
+//	window = "1m"
+type QuotaConfig struct {
+	Default Quota            `toml:"default"`
+	Tenants map[string]Quota `toml:"tenants"`
+}
+
+// LoadQuotaConfig reads a TOML quota file.
+func LoadQuotaConfig(filename string) (QuotaConfig, error) {
+	var config QuotaConfig
+	_, err := toml.DecodeFile(filename, &config)
+	return config, err
+}
+
+// QuotaLimiter enforces the quotas of a QuotaConfig with the counters of a
+// RateLimitStore.
+type QuotaLimiter struct {
+	config QuotaConfig
+	store  RateLimitStore
+	now    func() time.Time
+}
+
+// NewQuotaLimiter returns a QuotaLimiter enforcing config.
+func NewQuotaLimiter(config QuotaConfig, store RateLimitStore) *QuotaLimiter {
+	return &QuotaLimiter{config: config, store: store, now: time.Now}
+}
+
+// Allow records a request of tenant and reports whether it is within quota.
+// Otherwise it returns how long to wait before retrying. Rejected requests
+// are recorded too, so that clients retrying in a tight loop stay throttled.
+func (l *QuotaLimiter) Allow(ctx context.Context, tenant string) (bool, time.Duration, error) {
+	quota, ok := l.config.Tenants[tenant]
+	if !ok {
+		quota = l.config.Default
+	}
+	window := time.Duration(quota.Window)
+	if quota.Limit <= 0 || window <= 0 {
+		return true, 0, nil
+	}
+
+	now := l.now()
+	start := now.Truncate(window)
+	current, previous, err := l.store.Incr(ctx, "quota:"+tenant, window, start)
+	if err != nil {
+		return false, 0, err
+	}
+
+	overlap := 1 - float64(now.Sub(start))/float64(window)
+	count := float64(previous)*overlap + float64(current)
+	if count <= float64(quota.Limit) {
+		return true, 0, nil
+	}
+
+	// Wait for enough of the previous window to slide out, or for the
+	// current one to end if that is not enough.
+	retryAfter := start.Add(window).Sub(now)
+	if previous > 0 {
+		if d := time.Duration((count - float64(quota.Limit)) / float64(previous) * float64(window)); d < retryAfter {
+			retryAfter = d
+		}
+	}
+	return false, retryAfter, nil
+}
+
+// QuotaMiddleware returns an endpoint middleware rejecting the calls of
+// tenants over their quota with codes.ResourceExhausted (429 over HTTP), like
+// RateLimitingMiddleware. Calls are let through if the store fails, so that
+// an unavailable store does not take the gateway down. It must be wrapped by
+// the authentication middleware so that tenants can be identified.
+func QuotaMiddleware(limiter *QuotaLimiter, method string, throttled metrics.Counter, logger log.Logger) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			tenant := TenantFromContext(ctx)
+			ok, retryAfter, err := limiter.Allow(ctx, tenant)
+			if err != nil {
+				logger.Log("level", "error", "msg", "quota check failed, letting the request through", "method", method, "tenant", tenant, "err", err)
+				return next(ctx, request)
+			}
+			if !ok {
+				throttled.With("scope", "tenant").Add(1)
+				return nil, rateLimitError(retryAfter)
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// TenantFromContext returns the tenant of the caller: the tenant of its API
+// key or the "tenant" claim of its JWT. Callers without a tenant are their own
+// tenant, see ClientIdentity.
+func TenantFromContext(ctx context.Context) string {
+	if key, ok := APIKeyFromContext(ctx); ok && key.Tenant != "" {
+		return key.Tenant
+	}
+	if claims, ok := ClaimsFromContext(ctx); ok {
+		if tenant, ok := claims["tenant"].(string); ok && tenant != "" {
+			return tenant
+		}
+	}
+	client, _ := ClientIdentity(ctx)
+	return client
+}
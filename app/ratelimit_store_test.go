@@ -0,0 +1,150 @@
+package addsvc
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a Redis server supporting just enough commands for
+// RedisRateLimitStore. Keys never expire.
+type fakeRedis struct {
+	ln   net.Listener
+	mtx  sync.Mutex
+	data map[string]string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{ln: ln, data: map[string]string{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for {
+		command, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		args := command.([]interface{})
+		name := string(args[0].([]byte))
+		key := string(args[1].([]byte))
+
+		s.mtx.Lock()
+		switch name {
+		case "INCR":
+			n, _ := strconv.ParseInt(s.data[key], 10, 64)
+			n++
+			s.data[key] = strconv.FormatInt(n, 10)
+			fmt.Fprintf(w, ":%d\r\n", n)
+		case "PEXPIRE":
+			fmt.Fprint(w, ":1\r\n")
+		case "GET":
+			if v, ok := s.data[key]; ok {
+				fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				fmt.Fprint(w, "$-1\r\n")
+			}
+		default:
+			fmt.Fprintf(w, "-ERR unknown command '%s'\r\n", name)
+		}
+		s.mtx.Unlock()
+		w.Flush()
+	}
+}
+
+func testRateLimitStore(t *testing.T, store RateLimitStore) {
+	ctx := context.Background()
+	start := time.Unix(60, 0)
+
+	for i, want := range [][2]int64{{1, 0}, {2, 0}} {
+		current, previous, err := store.Incr(ctx, "a", time.Minute, start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current != want[0] || previous != want[1] {
+			t.Errorf("request %d: want %v, have [%d %d]", i, want, current, previous)
+		}
+	}
+
+	current, previous, err := store.Incr(ctx, "a", time.Minute, start.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != 1 || previous != 2 {
+		t.Errorf("next window: want [1 2], have [%d %d]", current, previous)
+	}
+
+	current, previous, err = store.Incr(ctx, "b", time.Minute, start.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != 1 || previous != 0 {
+		t.Errorf("other key: want [1 0], have [%d %d]", current, previous)
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	testRateLimitStore(t, NewMemoryRateLimitStore())
+}
+
+func TestRedisRateLimitStore(t *testing.T) {
+	server := newFakeRedis(t)
+	defer server.ln.Close()
+
+	store := NewRedisRateLimitStore(server.ln.Addr().String(), 2, time.Second)
+	defer store.Close()
+	testRateLimitStore(t, store)
+
+	if _, err := store.do(context.Background(), []string{"FLUSHALL", "x"}); err == nil {
+		t.Error("want the error reply to be returned")
+	}
+}
+
+func TestQuotaLimiter(t *testing.T) {
+	now := time.Unix(60, 0)
+	l := NewQuotaLimiter(QuotaConfig{
+		Default: Quota{Limit: 2, Window: duration(time.Minute)},
+		Tenants: map[string]Quota{"acme": {Limit: 10, Window: duration(time.Minute)}},
+	}, NewMemoryRateLimitStore())
+	l.now = func() time.Time { return now }
+
+	for i, want := range []bool{true, true, false} {
+		if ok, _, _ := l.Allow(context.Background(), "other"); ok != want {
+			t.Errorf("request %d: want %v, have %v", i, want, ok)
+		}
+	}
+	if ok, _, _ := l.Allow(context.Background(), "acme"); !ok {
+		t.Error("acme has its own quota")
+	}
+
+	// Three quarters through the next window, a quarter of the 3 requests
+	// above still count: 0.75 + 1 <= 2 is allowed, 0.75 + 2 is not.
+	now = now.Add(105 * time.Second)
+	if ok, _, _ := l.Allow(context.Background(), "other"); !ok {
+		t.Error("want the request to be allowed as the window slides")
+	}
+	ok, retryAfter, _ := l.Allow(context.Background(), "other")
+	if ok || retryAfter != 15*time.Second {
+		t.Errorf("want a 15s retry, have %v %v", ok, retryAfter)
+	}
+}
@@ -0,0 +1,78 @@
+package addsvc
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/discard"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewRateLimiter(RateLimitConfig{
+		Global:  Limit{Rate: 10, Burst: 3},
+		Client:  Limit{Rate: 1, Burst: 2},
+		Methods: map[string]Limit{"AddTask": {Rate: 0.5, Burst: 1}},
+		Tiers:   map[string]Limit{"premium": {Rate: 100, Burst: 100}},
+	})
+	l.now = func() time.Time { return now }
+
+	for i, want := range []bool{true, true, false} {
+		if ok, _, _ := l.Allow("Ping", "a", ""); ok != want {
+			t.Errorf("Ping %d: want %v, have %v", i, want, ok)
+		}
+	}
+
+	ok, scope, retryAfter := l.Allow("AddTask", "a", "premium")
+	if !ok {
+		t.Fatal("first AddTask should be allowed")
+	}
+	ok, scope, retryAfter = l.Allow("AddTask", "a", "premium")
+	if ok || scope != "client" || retryAfter != 2*time.Second {
+		t.Errorf("want client limit with a 2s retry, have %v %q %v", ok, scope, retryAfter)
+	}
+
+	// The global bucket is exhausted by the three calls above
+	ok, scope, _ = l.Allow("SayHello", "b", "")
+	if ok || scope != "global" {
+		t.Errorf("want global limit, have %v %q", ok, scope)
+	}
+
+	now = now.Add(time.Second)
+	if ok, _, _ := l.Allow("Ping", "a", ""); !ok {
+		t.Error("Ping should be allowed after a refill")
+	}
+}
+
+func TestRateLimitingMiddleware(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{Client: Limit{Rate: 1, Burst: 1}})
+	e := RateLimitingMiddleware(l, "Ping", discard.NewCounter())(func(context.Context, interface{}) (interface{}, error) {
+		return nil, nil
+	})
+
+	ctx := context.WithValue(context.Background(), httptransport.ContextKeyRequestRemoteAddr, "10.0.0.1:1234")
+	if _, err := e(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err := e(ctx, nil)
+	if grpc.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("want ResourceExhausted, have %v", err)
+	}
+
+	// Other addresses have their own bucket
+	other := context.WithValue(context.Background(), httptransport.ContextKeyRequestRemoteAddr, "10.0.0.2:1234")
+	if _, err := e(other, nil); err != nil {
+		t.Errorf("want other clients to be allowed, have %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	errorEncoder(context.Background(), err, rec)
+	if rec.Code != 429 || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("want 429 with Retry-After: 1, have %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
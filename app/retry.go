@@ -0,0 +1,240 @@
+package addsvc
+
+// This file provides retries of failed backend calls. Only idempotent
+// methods are retried, or calls carrying an idempotency key the backend can
+// deduplicate them with, and retries are limited by a budget so that they
+// cannot multiply the load on a struggling backend.
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+type idempotencyKeyContextKey struct{}
+
+// RetryPolicy configures the retries of a method.
+type RetryPolicy struct {
+	// Idempotent methods are always retried, others only when the call
+	// carries an idempotency key.
+	Idempotent bool `toml:"idempotent"`
+	// MaxAttempts is the maximum number of calls, including the first one.
+	MaxAttempts int `toml:"max_attempts"`
+	// Retries are delayed by a random backoff between zero and
+	// InitialBackoff*2^retry, capped by MaxBackoff.
+	InitialBackoff duration `toml:"initial_backoff"`
+	MaxBackoff     duration `toml:"max_backoff"`
+	// Codes are the gRPC codes retried i.e. Unavailable.
+	Codes []string `toml:"codes"`
+	// Budget caps the retries to that fraction of the calls.
+	Budget float64 `toml:"budget"`
+}
+
+// RetryConfig holds the retry policies of the gateway methods, loaded from a
+// TOML file i.e.
+//
+//	[default]
+//	max_attempts = 3
+//	initial_backoff = "25ms"
+//	max_backoff = "250ms"
+//	codes = ["Unavailable"]
+//	budget = 0.1
+//
+//	[methods.Ping]
+//	idempotent = true
+//
+// Method policies only need to set the values differing from the default.
+type RetryConfig struct {
+	Default RetryPolicy            `toml:"default"`
+	Methods map[string]RetryPolicy `toml:"methods"`
+}
+
+// DefaultRetryConfig retries the read-only methods on Unavailable.
+var DefaultRetryConfig = RetryConfig{
+	Default: RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: duration(25 * time.Millisecond),
+		MaxBackoff:     duration(250 * time.Millisecond),
+		Codes:          []string{"Unavailable"},
+		Budget:         0.1,
+	},
+	Methods: map[string]RetryPolicy{
+		"Ping":               {Idempotent: true},
+		"SayHello":           {Idempotent: true},
+		"GetAvailableAgents": {Idempotent: true},
+	},
+}
+
+// LoadRetryConfig reads a TOML retry file. The default policy starts from
+// the one of DefaultRetryConfig, so that the file only needs to set the
+// values differing from it.
+func LoadRetryConfig(filename string) (RetryConfig, error) {
+	config := RetryConfig{Default: DefaultRetryConfig.Default}
+	if _, err := toml.DecodeFile(filename, &config); err != nil {
+		return RetryConfig{}, err
+	}
+	if config.Default.MaxAttempts < 1 {
+		return RetryConfig{}, fmt.Errorf("default: max_attempts must be at least 1, have %d", config.Default.MaxAttempts)
+	}
+	for method := range config.Methods {
+		if p := config.Policy(method); p.MaxAttempts < 1 {
+			return RetryConfig{}, fmt.Errorf("method %s: max_attempts must be at least 1, have %d", method, p.MaxAttempts)
+		}
+	}
+	return config, nil
+}
+
+// Policy returns the retry policy of method, completed with the default
+// policy.
+func (c RetryConfig) Policy(method string) RetryPolicy {
+	p, ok := c.Methods[method]
+	if !ok {
+		return c.Default
+	}
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = c.Default.MaxAttempts
+	}
+	if p.InitialBackoff == 0 {
+		p.InitialBackoff = c.Default.InitialBackoff
+	}
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = c.Default.MaxBackoff
+	}
+	if p.Codes == nil {
+		p.Codes = c.Default.Codes
+	}
+	if p.Budget == 0 {
+		p.Budget = c.Default.Budget
+	}
+	return p
+}
+
+// retryableCodes maps the code names of a RetryPolicy to their codes.
+var retryableCodes = map[string]codes.Code{
+	"Canceled":          codes.Canceled,
+	"Unknown":           codes.Unknown,
+	"DeadlineExceeded":  codes.DeadlineExceeded,
+	"ResourceExhausted": codes.ResourceExhausted,
+	"Aborted":           codes.Aborted,
+	"Internal":          codes.Internal,
+	"Unavailable":       codes.Unavailable,
+}
+
+// retryBudget earns Budget tokens per call and spends one per retry. It
+// holds at most maxRetryTokens, so that some retries are allowed even at low
+// traffic.
+type retryBudget struct {
+	ratio  float64
+	mtx    sync.Mutex
+	tokens float64
+}
+
+const maxRetryTokens = 10
+
+func (b *retryBudget) deposit() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.tokens += b.ratio; b.tokens > maxRetryTokens {
+		b.tokens = maxRetryTokens
+	}
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// IdempotencyKeyHTTPToContext moves the Idempotency-Key header of the
+// request into the context.
+func IdempotencyKeyHTTPToContext() httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		if key := r.Header.Get("Idempotency-Key"); key != "" {
+			return context.WithValue(ctx, idempotencyKeyContextKey{}, key)
+		}
+		return ctx
+	}
+}
+
+// IdempotencyKeyGRPCToContext moves the idempotency-key metadata of the
+// request into the context.
+func IdempotencyKeyGRPCToContext() grpctransport.ServerRequestFunc {
+	return func(ctx context.Context, md metadata.MD) context.Context {
+		if keys := md["idempotency-key"]; len(keys) > 0 && keys[0] != "" {
+			return context.WithValue(ctx, idempotencyKeyContextKey{}, keys[0])
+		}
+		return ctx
+	}
+}
+
+// RetryMiddleware returns an endpoint middleware retrying the failed calls
+// to method according to policy. Calls to methods which are not idempotent
+// are only retried when they carry an idempotency key, which is forwarded to
+// the backend as idempotency-key metadata. Business errors bundled in the
+// response are never retried. Retries are counted in retries.
+func RetryMiddleware(policy RetryPolicy, retries metrics.Counter) endpoint.Middleware {
+	retryable := map[codes.Code]bool{}
+	for _, name := range policy.Codes {
+		if code, ok := retryableCodes[name]; ok {
+			retryable[code] = true
+		}
+	}
+	budget := &retryBudget{ratio: policy.Budget, tokens: maxRetryTokens}
+
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			budget.deposit()
+
+			key, hasKey := ctx.Value(idempotencyKeyContextKey{}).(string)
+			if hasKey {
+				md, _ := metadata.FromOutgoingContext(ctx)
+				ctx = metadata.NewOutgoingContext(ctx, metadata.Join(md, metadata.Pairs("idempotency-key", key)))
+			}
+			if !policy.Idempotent && !hasKey {
+				return next(ctx, request)
+			}
+
+			for attempt := 1; ; attempt++ {
+				response, err = next(ctx, request)
+				if err == nil || !retryable[grpc.Code(err)] || attempt >= policy.MaxAttempts || !budget.withdraw() {
+					return response, err
+				}
+
+				select {
+				case <-time.After(retryBackoff(policy, attempt)):
+				case <-ctx.Done():
+					return response, err
+				}
+				retries.Add(1)
+			}
+		}
+	}
+}
+
+// retryBackoff returns a random delay before the retry following attempt.
+func retryBackoff(policy RetryPolicy, attempt int) time.Duration {
+	backoff := time.Duration(policy.InitialBackoff) << uint(attempt-1)
+	if max := time.Duration(policy.MaxBackoff); max > 0 && (backoff > max || backoff <= 0) {
+		backoff = max
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
@@ -0,0 +1,149 @@
+package addsvc
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/discard"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryMiddleware(t *testing.T) {
+	config := RetryConfig{
+		Default: RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: duration(time.Millisecond),
+			MaxBackoff:     duration(time.Millisecond),
+			Codes:          []string{"Unavailable"},
+			Budget:         1,
+		},
+		Methods: map[string]RetryPolicy{"Ping": {Idempotent: true}},
+	}
+
+	calls := 0
+	var failWith error
+	var forwardedKey []string
+	backend := func(ctx context.Context, _ interface{}) (interface{}, error) {
+		calls++
+		md, _ := metadata.FromOutgoingContext(ctx)
+		forwardedKey = md["idempotency-key"]
+		return nil, failWith
+	}
+	keyContext := context.WithValue(context.Background(), idempotencyKeyContextKey{}, "task-42")
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		ctx    context.Context
+		err    error
+		calls  int
+	}{
+		{"idempotent", "Ping", context.Background(), status.Error(codes.Unavailable, "down"), 3},
+		{"not retryable", "Ping", context.Background(), status.Error(codes.Internal, "bug"), 1},
+		{"not idempotent", "AddTask", context.Background(), status.Error(codes.Unavailable, "down"), 1},
+		{"idempotency key", "AddTask", keyContext, status.Error(codes.Unavailable, "down"), 3},
+		{"success", "Ping", context.Background(), nil, 1},
+	} {
+		calls, failWith = 0, tc.err
+		e := RetryMiddleware(config.Policy(tc.method), discard.NewCounter())(backend)
+		if _, err := e(tc.ctx, nil); grpc.Code(err) != grpc.Code(tc.err) {
+			t.Errorf("%s: want %v, have %v", tc.name, tc.err, err)
+		}
+		if calls != tc.calls {
+			t.Errorf("%s: want %d calls, have %d", tc.name, tc.calls, calls)
+		}
+	}
+	if len(forwardedKey) != 0 {
+		t.Errorf("want no idempotency key forwarded, have %v", forwardedKey)
+	}
+
+	e := RetryMiddleware(config.Policy("AddTask"), discard.NewCounter())(backend)
+	e(keyContext, nil)
+	if len(forwardedKey) != 1 || forwardedKey[0] != "task-42" {
+		t.Errorf("want the idempotency key forwarded to the backend, have %v", forwardedKey)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	policy := RetryPolicy{Idempotent: true, MaxAttempts: 2, Codes: []string{"Unavailable"}, Budget: 0.1}
+
+	calls := 0
+	e := RetryMiddleware(policy, discard.NewCounter())(func(context.Context, interface{}) (interface{}, error) {
+		calls++
+		return nil, status.Error(codes.Unavailable, "down")
+	})
+
+	// The budget starts full, then only earns a retry about every 10 calls
+	for i := 0; i < 20; i++ {
+		e(context.Background(), nil)
+	}
+	if retried := calls - 20; retried < maxRetryTokens || retried > maxRetryTokens+2 {
+		t.Errorf("want about %d retries, have %d", maxRetryTokens+2, retried)
+	}
+}
+
+func TestLoadRetryConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"partial default", `
+			[default]
+			budget = 0.2
+
+			[methods.SayHello]
+			idempotent = true
+		`, ""},
+		{"no attempts", `
+			[default]
+			max_attempts = 0
+		`, "default: max_attempts must be at least 1"},
+		{"negative method attempts", `
+			[methods.SayHello]
+			max_attempts = -1
+		`, "method SayHello: max_attempts must be at least 1"},
+		{"invalid TOML", `[default`, "expected"},
+	} {
+		filename := filepath.Join(dir, strings.Replace(tc.name, " ", "_", -1)+".toml")
+		if err := ioutil.WriteFile(filename, []byte(tc.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		config, err := LoadRetryConfig(filename)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: want an error containing %q, have %v", tc.name, tc.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		want := DefaultRetryConfig.Default
+		want.Budget = 0.2
+		if have := config.Policy("Ping"); !reflect.DeepEqual(have, want) {
+			t.Errorf("%s: want the unset values of the default policy kept, have %+v", tc.name, have)
+		}
+		want.Idempotent = true
+		if have := config.Policy("SayHello"); !reflect.DeepEqual(have, want) {
+			t.Errorf("%s: want %+v, have %+v", tc.name, want, have)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package addsvc
+
+// This file provides load shedding by priority. Calls beyond the in flight
+// limit of the gateway wait in a queue served highest priority first, and the
+// lowest priority calls are dropped first when the queue is full, so that
+// during an incident the agents keep their heartbeats and calls while
+// greetings and debug traffic are shed.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	httptransport "github.com/go-kit/kit/transport/http"
+	oldcontext "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+type (
+	priorityContextKey          struct{}
+	requestedPriorityContextKey struct{}
+)
+
+// Priority is the priority of a call when shedding load. The zero value is
+// PriorityNormal.
+type Priority int
+
+const (
+	PrioritySheddable Priority = iota - 1
+	PriorityNormal
+	PriorityCritical
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySheddable:
+		return "sheddable"
+	case PriorityCritical:
+		return "critical"
+	default:
+		return "normal"
+	}
+}
+
+// ParsePriority parses the name of a priority: sheddable, normal or
+// critical.
+func ParsePriority(s string) (Priority, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "sheddable":
+		return PrioritySheddable, nil
+	case "normal":
+		return PriorityNormal, nil
+	case "critical":
+		return PriorityCritical, nil
+	}
+	return PriorityNormal, fmt.Errorf("invalid priority %q, want sheddable, normal or critical", s)
+}
+
+func (p *Priority) UnmarshalText(text []byte) (err error) {
+	*p, err = ParsePriority(string(text))
+	return err
+}
+
+// network is a net.IPNet decoded from CIDR strings such as "10.0.0.0/8".
+type network struct {
+	*net.IPNet
+}
+
+func (n *network) UnmarshalText(text []byte) (err error) {
+	_, n.IPNet, err = net.ParseCIDR(string(text))
+	return err
+}
+
+// SheddingPolicy holds the load shedding priority of a method.
+type SheddingPolicy struct {
+	Priority Priority `toml:"priority"`
+}
+
+// SheddingConfig holds the priorities of the gateway methods, loaded from a
+// TOML file i.e.
+//
+//	trusted_networks = ["127.0.0.0/8"]
+//
+//	[default]
+//	priority = "normal"
+//
+//	[methods.HeartBeat]
+//	priority = "critical"
+//
+// Callers from the trusted networks may set the priority of a call with the
+// X-Request-Priority header (x-request-priority metadata over gRPC). Trust
+// goes by the address of the direct peer, so the network of a load balancer
+// or ingress in front of the gateway must not be trusted unless the ingress
+// strips the header.
+type SheddingConfig struct {
+	TrustedNetworks []network                 `toml:"trusted_networks"`
+	Default         SheddingPolicy            `toml:"default"`
+	Methods         map[string]SheddingPolicy `toml:"methods"`
+}
+
+// DefaultSheddingConfig preserves the agent heartbeats and calls over the
+// greetings.
+var DefaultSheddingConfig = SheddingConfig{
+	Default: SheddingPolicy{Priority: PriorityNormal},
+	Methods: map[string]SheddingPolicy{
+		"HeartBeat":  {Priority: PriorityCritical},
+		"AcceptCall": {Priority: PriorityCritical},
+		"SayHello":   {Priority: PrioritySheddable},
+		"SayWorld":   {Priority: PrioritySheddable},
+	},
+}
+
+// LoadSheddingConfig reads a TOML shedding file.
+func LoadSheddingConfig(filename string) (SheddingConfig, error) {
+	var config SheddingConfig
+	_, err := toml.DecodeFile(filename, &config)
+	return config, err
+}
+
+// Priority returns the priority of method.
+func (c SheddingConfig) Priority(method string) Priority {
+	if p, ok := c.Methods[method]; ok {
+		return p.Priority
+	}
+	return c.Default.Priority
+}
+
+// RoutePriority returns the priority of route, its own if set and the one
+// of its method otherwise.
+func (c SheddingConfig) RoutePriority(route Route) Priority {
+	if p, err := ParsePriority(route.Priority); err == nil && route.Priority != "" {
+		return p
+	}
+	return c.Priority(route.RPC)
+}
+
+func (c SheddingConfig) trusts(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.TrustedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// PriorityHTTPToContext moves the X-Request-Priority header of the request
+// into the context. It is only honoured for trusted callers.
+func PriorityHTTPToContext() httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		if priority := r.Header.Get("X-Request-Priority"); priority != "" {
+			return context.WithValue(ctx, requestedPriorityContextKey{}, priority)
+		}
+		return ctx
+	}
+}
+
+// PriorityGRPCToContext moves the x-request-priority metadata of the request
+// into the context. It is only honoured for trusted callers.
+func PriorityGRPCToContext() grpctransport.ServerRequestFunc {
+	return func(ctx context.Context, md metadata.MD) context.Context {
+		if priorities := md["x-request-priority"]; len(priorities) > 0 && priorities[0] != "" {
+			return context.WithValue(ctx, requestedPriorityContextKey{}, priorities[0])
+		}
+		return ctx
+	}
+}
+
+// PriorityHandler gives the calls served by next priority, whatever their
+// method i.e. to shed the debug listeners first.
+func PriorityHandler(priority Priority, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), priorityContextKey{}, priority)))
+	})
+}
+
+// PriorityUnaryInterceptor is the gRPC server counterpart of PriorityHandler.
+func PriorityUnaryInterceptor(priority Priority) grpc.UnaryServerInterceptor {
+	return func(ctx oldcontext.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(context.WithValue(ctx, priorityContextKey{}, priority), req)
+	}
+}
+
+// SheddingSettings configures a LoadShedder. Calls beyond MaxInFlight wait
+// in a queue of at most MaxQueue calls, for at most MaxQueueTime.
+type SheddingSettings struct {
+	MaxInFlight  int
+	MaxQueue     int
+	MaxQueueTime time.Duration
+}
+
+type shedWaiter struct {
+	priority Priority
+	admitted chan bool
+}
+
+// LoadShedder limits the calls in flight through the gateway. Waiting calls
+// are admitted highest priority first, so the lowest priority calls are the
+// ones exceeding MaxQueueTime first, and a full queue drops its lowest
+// priority call, the most recent one among equals, to make room for a higher
+// priority one. It is safe for concurrent use.
+type LoadShedder struct {
+	settings SheddingSettings
+
+	mtx      sync.Mutex
+	inFlight int
+	queue    []*shedWaiter
+
+	inFlightGauge metrics.Gauge
+	queuedGauge   metrics.Gauge
+	shed          metrics.Counter
+}
+
+// NewLoadShedder returns a LoadShedder. The counter of shed calls must be
+// labelled by "priority" and "reason".
+func NewLoadShedder(settings SheddingSettings, inFlight, queued metrics.Gauge, shed metrics.Counter) *LoadShedder {
+	if settings.MaxInFlight < 1 {
+		settings.MaxInFlight = 1
+	}
+	return &LoadShedder{
+		settings:      settings,
+		inFlightGauge: inFlight,
+		queuedGauge:   queued,
+		shed:          shed,
+	}
+}
+
+// acquire admits a call of priority, waiting in the queue if needed. It
+// returns false and the reason if the call must be shed.
+func (s *LoadShedder) acquire(ctx context.Context, priority Priority) (bool, string) {
+	s.mtx.Lock()
+	if s.inFlight < s.settings.MaxInFlight {
+		s.inFlight++
+		s.inFlightGauge.Set(float64(s.inFlight))
+		s.mtx.Unlock()
+		return true, ""
+	}
+	if s.settings.MaxQueue < 1 {
+		s.mtx.Unlock()
+		return false, "in_flight"
+	}
+	if len(s.queue) >= s.settings.MaxQueue {
+		i := s.lowest()
+		if s.queue[i].priority >= priority {
+			s.mtx.Unlock()
+			return false, "queue_full"
+		}
+		victim := s.queue[i]
+		s.remove(i)
+		victim.admitted <- false
+	}
+	w := &shedWaiter{priority: priority, admitted: make(chan bool, 1)}
+	s.queue = append(s.queue, w)
+	s.queuedGauge.Set(float64(len(s.queue)))
+	s.mtx.Unlock()
+
+	timer := time.NewTimer(s.settings.MaxQueueTime)
+	defer timer.Stop()
+
+	select {
+	case admitted := <-w.admitted:
+		if !admitted {
+			return false, "queue_full"
+		}
+		return true, ""
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	s.mtx.Lock()
+	for i := range s.queue {
+		if s.queue[i] == w {
+			s.remove(i)
+			s.mtx.Unlock()
+			return false, "queue_time"
+		}
+	}
+	s.mtx.Unlock()
+
+	// Admitted or dropped meanwhile
+	if admitted := <-w.admitted; !admitted {
+		return false, "queue_full"
+	}
+	return true, ""
+}
+
+// release hands the slot of a call over to the highest priority waiting
+// call, the oldest one among equals.
+func (s *LoadShedder) release() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if len(s.queue) == 0 {
+		s.inFlight--
+		s.inFlightGauge.Set(float64(s.inFlight))
+		return
+	}
+	next := 0
+	for i, w := range s.queue {
+		if w.priority > s.queue[next].priority {
+			next = i
+		}
+	}
+	w := s.queue[next]
+	s.remove(next)
+	w.admitted <- true
+}
+
+// lowest returns the index of the lowest priority waiting call, the most
+// recent one among equals.
+func (s *LoadShedder) lowest() int {
+	lowest := len(s.queue) - 1
+	for i := lowest - 1; i >= 0; i-- {
+		if s.queue[i].priority < s.queue[lowest].priority {
+			lowest = i
+		}
+	}
+	return lowest
+}
+
+func (s *LoadShedder) remove(i int) {
+	s.queue = append(s.queue[:i], s.queue[i+1:]...)
+	s.queuedGauge.Set(float64(len(s.queue)))
+}
+
+// LoadSheddingMiddleware returns an endpoint middleware admitting the calls
+// to method through shedder with priority, unless the listener set another
+// one or a caller from the trusted networks of config asked for another one.
+// Shed calls fail with codes.ResourceExhausted (503 over HTTP).
+func LoadSheddingMiddleware(shedder *LoadShedder, config SheddingConfig, method string, priority Priority) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			p := priority
+			if listener, ok := ctx.Value(priorityContextKey{}).(Priority); ok {
+				p = listener
+			}
+			if requested, ok := ctx.Value(requestedPriorityContextKey{}).(string); ok && config.trusts(remoteHost(ctx)) {
+				if parsed, err := ParsePriority(requested); err == nil {
+					p = parsed
+				}
+			}
+
+			admitted, reason := shedder.acquire(ctx, p)
+			if !admitted {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				shedder.shed.With("priority", p.String(), "reason", reason).Add(1)
+				return nil, overloadError("method", method)
+			}
+			defer shedder.release()
+			return next(ctx, request)
+		}
+	}
+}
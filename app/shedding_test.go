@@ -0,0 +1,142 @@
+package addsvc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-kit/kit/metrics/discard"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestLoadShedderPriorities(t *testing.T) {
+	s := NewLoadShedder(SheddingSettings{MaxInFlight: 1, MaxQueue: 2, MaxQueueTime: time.Second}, discard.NewGauge(), discard.NewGauge(), discard.NewCounter())
+	if ok, _ := s.acquire(context.Background(), PriorityNormal); !ok {
+		t.Fatal("want a free slot")
+	}
+
+	type result struct {
+		priority Priority
+		admitted bool
+		reason   string
+	}
+	results := make(chan result, 3)
+	wait := func(p Priority) {
+		go func() {
+			ok, reason := s.acquire(context.Background(), p)
+			results <- result{p, ok, reason}
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The queue fills up, then the critical call drops the sheddable one
+	wait(PrioritySheddable)
+	wait(PriorityNormal)
+	wait(PriorityCritical)
+	if r := <-results; r.priority != PrioritySheddable || r.admitted || r.reason != "queue_full" {
+		t.Fatalf("want the sheddable call dropped, have %+v", r)
+	}
+
+	// Another sheddable call does not make it into the full queue
+	if ok, reason := s.acquire(context.Background(), PrioritySheddable); ok || reason != "queue_full" {
+		t.Fatalf("want the sheddable call dropped, have %v %s", ok, reason)
+	}
+
+	// Released slots go to the highest priority first
+	s.release()
+	if r := <-results; r.priority != PriorityCritical || !r.admitted {
+		t.Fatalf("want the critical call admitted, have %+v", r)
+	}
+	s.release()
+	if r := <-results; r.priority != PriorityNormal || !r.admitted {
+		t.Fatalf("want the normal call admitted, have %+v", r)
+	}
+}
+
+func TestLoadShedderQueueTime(t *testing.T) {
+	s := NewLoadShedder(SheddingSettings{MaxInFlight: 1, MaxQueue: 1, MaxQueueTime: 10 * time.Millisecond}, discard.NewGauge(), discard.NewGauge(), discard.NewCounter())
+	if ok, _ := s.acquire(context.Background(), PriorityNormal); !ok {
+		t.Fatal("want a free slot")
+	}
+	if ok, reason := s.acquire(context.Background(), PriorityCritical); ok || reason != "queue_time" {
+		t.Fatalf("want the call shed after waiting, have %v %s", ok, reason)
+	}
+
+	// The queued call is gone, releasing frees the slot
+	s.release()
+	if ok, _ := s.acquire(context.Background(), PrioritySheddable); !ok {
+		t.Error("want a free slot")
+	}
+}
+
+func TestLoadSheddingMiddlewareTrustedPriority(t *testing.T) {
+	var config SheddingConfig
+	if _, err := toml.Decode(`
+		trusted_networks = ["10.0.0.0/8"]
+
+		[default]
+		priority = "normal"
+
+		[methods.SayHello]
+		priority = "sheddable"
+	`, &config); err != nil {
+		t.Fatal(err)
+	}
+	if have := config.Priority("SayHello"); have != PrioritySheddable {
+		t.Fatalf("want sheddable, have %s", have)
+	}
+	if have := config.RoutePriority(Route{RPC: "SayHello", Priority: "critical"}); have != PriorityCritical {
+		t.Fatalf("want critical, have %s", have)
+	}
+
+	s := NewLoadShedder(SheddingSettings{MaxInFlight: 1, MaxQueue: 1, MaxQueueTime: time.Second}, discard.NewGauge(), discard.NewGauge(), discard.NewCounter())
+	e := LoadSheddingMiddleware(s, config, "SayHello", config.Priority("SayHello"))(func(ctx context.Context, _ interface{}) (interface{}, error) {
+		return nil, nil
+	})
+
+	// Hold the slot and queue a normal call
+	if ok, _ := s.acquire(context.Background(), PriorityNormal); !ok {
+		t.Fatal("want a free slot")
+	}
+	done := make(chan bool)
+	go func() {
+		ok, _ := s.acquire(context.Background(), PriorityNormal)
+		done <- ok
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	request := func(remoteAddr string) context.Context {
+		r := httptest.NewRequest("GET", "/v1/hello/x", nil)
+		r.Header.Set("X-Request-Priority", "critical")
+		ctx := PriorityHTTPToContext()(context.Background(), r)
+		return context.WithValue(ctx, httptransport.ContextKeyRequestRemoteAddr, remoteAddr)
+	}
+
+	// An untrusted caller cannot raise its priority
+	_, err := e(request("192.0.2.1:1234"), nil)
+	if grpc.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("want ResourceExhausted, have %v", err)
+	}
+	rec := httptest.NewRecorder()
+	errorEncoder(context.Background(), err, rec)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("want 503, have %d", rec.Code)
+	}
+
+	// A trusted one can, dropping the normal call
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.release()
+	}()
+	if _, err := e(request("10.1.2.3:1234"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if <-done {
+		t.Error("want the normal call dropped")
+	}
+}
@@ -0,0 +1,287 @@
+package addsvc
+
+// This file provides a generic gRPC transcoder. It uses the protobuf file
+// descriptors compiled into the gateway to resolve a fully qualified method
+// name to its request and response message types, so that any method can be
+// served over HTTP/JSON without hand-written request structs and codecs.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/protobuf/descriptor"
+	"github.com/golang/protobuf/proto"
+	protobuf "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/newtonsystems/grpc_types/go/grpc_types"
+	"google.golang.org/genproto/googleapis/api/annotations"
+)
+
+// RPCMethod describes a single unary gRPC method known to the transcoder.
+type RPCMethod struct {
+	Service  string // i.e. grpc_types.Hello
+	RPC      string // i.e. SayHello
+	Request  string // i.e. grpc_types.HelloRequest
+	Response string // i.e. grpc_types.HelloResponse
+
+	// HTTPRules holds the google.api.http annotations of the method, if any.
+	HTTPRules []*annotations.HttpRule
+}
+
+// FullMethod returns the gRPC method name i.e. /grpc_types.Hello/SayHello
+func (m RPCMethod) FullMethod() string {
+	return "/" + m.Service + "/" + m.RPC
+}
+
+// Transcoder indexes the gRPC methods of registered protobuf files.
+type Transcoder struct {
+	files   map[string]bool
+	methods map[string]RPCMethod
+	order   []string
+}
+
+// NewTranscoder returns an empty Transcoder. Use RegisterFile or
+// RegisterMessageFile to add the methods it knows about.
+func NewTranscoder() *Transcoder {
+	return &Transcoder{
+		files:   map[string]bool{},
+		methods: map[string]RPCMethod{},
+	}
+}
+
+// NewGRPCTypesTranscoder returns a Transcoder that knows about every grpc_types
+// service used by the gateway. New methods added to those proto files are
+// picked up without any gateway code change.
+func NewGRPCTypesTranscoder() (*Transcoder, error) {
+	t := NewTranscoder()
+
+	for _, msg := range []descriptor.Message{
+		&grpc_types.HelloRequest{},
+		&grpc_types.WorldRequest{},
+		&grpc_types.GetAvailableAgentsRequest{},
+		&grpc_types.GetAgentIDFromRefRequest{},
+		&grpc_types.AcceptCallRequest{},
+		&grpc_types.HeartBeatRequest{},
+		&grpc_types.AddTaskRequest{},
+		&grpc_types.PingRequest{},
+	} {
+		if err := t.RegisterMessageFile(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// RegisterMessageFile registers the protobuf file in which msg is declared.
+func (t *Transcoder) RegisterMessageFile(msg descriptor.Message) error {
+	gz, _ := msg.Descriptor()
+	return t.RegisterFile(gz)
+}
+
+// RegisterFile registers a gzipped FileDescriptorProto, as returned by
+// proto.FileDescriptor. Registering the same file twice is a no-op.
+func (t *Transcoder) RegisterFile(gz []byte) error {
+	fd, err := extractFileDescriptor(gz)
+	if err != nil {
+		return err
+	}
+	if t.files[fd.GetName()] {
+		return nil
+	}
+	t.files[fd.GetName()] = true
+
+	pkg := fd.GetPackage()
+	for _, sd := range fd.GetService() {
+		service := qualifiedName(pkg, sd.GetName())
+		for _, md := range sd.GetMethod() {
+			if md.GetClientStreaming() || md.GetServerStreaming() {
+				continue
+			}
+
+			m := RPCMethod{
+				Service:  service,
+				RPC:      md.GetName(),
+				Request:  strings.TrimPrefix(md.GetInputType(), "."),
+				Response: strings.TrimPrefix(md.GetOutputType(), "."),
+			}
+			if proto.MessageType(m.Request) == nil || proto.MessageType(m.Response) == nil {
+				return fmt.Errorf("%s: message types %s and %s must be compiled into the gateway", m.FullMethod(), m.Request, m.Response)
+			}
+
+			if md.Options != nil && proto.HasExtension(md.Options, annotations.E_Http) {
+				ext, err := proto.GetExtension(md.Options, annotations.E_Http)
+				if err != nil {
+					return fmt.Errorf("%s: %v", m.FullMethod(), err)
+				}
+				rule := ext.(*annotations.HttpRule)
+				m.HTTPRules = append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...)
+			}
+
+			if _, ok := t.methods[m.FullMethod()]; !ok {
+				t.order = append(t.order, m.FullMethod())
+			}
+			t.methods[m.FullMethod()] = m
+		}
+	}
+
+	return nil
+}
+
+// Method looks up a method by its fully qualified name. All of
+// "grpc_types.Hello.SayHello", "grpc_types.Hello/SayHello" and
+// "/grpc_types.Hello/SayHello" are accepted.
+func (t *Transcoder) Method(name string) (RPCMethod, error) {
+	name = strings.TrimPrefix(name, "/")
+	if !strings.Contains(name, "/") {
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			name = name[:i] + "/" + name[i+1:]
+		}
+	}
+
+	m, ok := t.methods["/"+name]
+	if !ok {
+		return RPCMethod{}, fmt.Errorf("unknown gRPC method %q", name)
+	}
+	return m, nil
+}
+
+// Methods returns every registered method in registration order.
+func (t *Transcoder) Methods() []RPCMethod {
+	methods := make([]RPCMethod, 0, len(t.order))
+	for _, name := range t.order {
+		methods = append(methods, t.methods[name])
+	}
+	return methods
+}
+
+// Resolve fills in the request and response message types of a route from
+// its service and rpc, when they are not declared explicitly.
+func (t *Transcoder) Resolve(route Route) (Route, error) {
+	if route.Request != "" && route.Response != "" {
+		return route, nil
+	}
+
+	m, err := t.Method(route.FullMethod())
+	if err != nil {
+		return Route{}, err
+	}
+	if route.Request == "" {
+		route.Request = m.Request
+	}
+	if route.Response == "" {
+		route.Response = m.Response
+	}
+	return route, nil
+}
+
+// AnnotatedRoutes returns a route for every google.api.http binding of the
+// registered methods. Only simple path templates are supported i.e.
+// /v1/agents/{agent_id}; bindings using nested fields or wildcards are skipped.
+func (t *Transcoder) AnnotatedRoutes() []Route {
+	var routes []Route
+	for _, m := range t.Methods() {
+		for _, rule := range m.HTTPRules {
+			method, path := httpRulePattern(rule)
+			if method == "" {
+				continue
+			}
+
+			fields := map[string]string{}
+			supported := true
+			for _, segment := range splitPath(path) {
+				if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+					if strings.Contains(segment, "*") {
+						supported = false
+					}
+					continue
+				}
+				param := segment[1 : len(segment)-1]
+				if strings.ContainsAny(param, ".=") {
+					supported = false
+					continue
+				}
+				fields[param] = param
+			}
+			if !supported {
+				continue
+			}
+
+			routes = append(routes, Route{
+				Method:   method,
+				Path:     path,
+				Service:  m.Service,
+				RPC:      m.RPC,
+				Request:  m.Request,
+				Response: m.Response,
+				Body:     rule.GetBody(),
+				Fields:   fields,
+			})
+		}
+	}
+	return routes
+}
+
+// RPCRoutes returns a POST route at <prefix>/<service>/<rpc> for every
+// registered method, taking the whole request message as the JSON body.
+func (t *Transcoder) RPCRoutes(prefix string) []Route {
+	var routes []Route
+	for _, m := range t.Methods() {
+		routes = append(routes, Route{
+			Method:   "POST",
+			Path:     strings.TrimSuffix(prefix, "/") + "/" + m.Service + "/" + m.RPC,
+			Service:  m.Service,
+			RPC:      m.RPC,
+			Request:  m.Request,
+			Response: m.Response,
+			Body:     "*",
+		})
+	}
+	return routes
+}
+
+func httpRulePattern(rule *annotations.HttpRule) (method, path string) {
+	switch pattern := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		return "GET", pattern.Get
+	case *annotations.HttpRule_Put:
+		return "PUT", pattern.Put
+	case *annotations.HttpRule_Post:
+		return "POST", pattern.Post
+	case *annotations.HttpRule_Delete:
+		return "DELETE", pattern.Delete
+	case *annotations.HttpRule_Patch:
+		return "PATCH", pattern.Patch
+	case *annotations.HttpRule_Custom:
+		return strings.ToUpper(pattern.Custom.GetKind()), pattern.Custom.GetPath()
+	}
+	return "", ""
+}
+
+func qualifiedName(pkg, name string) string {
+	if pkg == "" {
+		return name
+	}
+	return pkg + "." + name
+}
+
+func extractFileDescriptor(gz []byte) (*protobuf.FileDescriptorProto, error) {
+	r, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open gzip reader: %v", err)
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to uncompress descriptor: %v", err)
+	}
+
+	fd := new(protobuf.FileDescriptorProto)
+	if err := proto.Unmarshal(b, fd); err != nil {
+		return nil, fmt.Errorf("malformed FileDescriptorProto: %v", err)
+	}
+	return fd, nil
+}
@@ -0,0 +1,162 @@
+package addsvc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	protobuf "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"google.golang.org/genproto/googleapis/api/annotations"
+)
+
+func TestTranscoderResolve(t *testing.T) {
+	transcoder, err := NewGRPCTypesTranscoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"grpc_types.Hello.SayHello", "grpc_types.Hello/SayHello", "/grpc_types.Hello/SayHello"} {
+		m, err := transcoder.Method(name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if m.Request != "grpc_types.HelloRequest" || m.Response != "grpc_types.HelloResponse" {
+			t.Errorf("%s: want grpc_types.HelloRequest and grpc_types.HelloResponse, have %s and %s", name, m.Request, m.Response)
+		}
+	}
+
+	route, err := transcoder.Resolve(Route{Service: "grpc_types.Hello", RPC: "SayHello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.Request != "grpc_types.HelloRequest" || route.Response != "grpc_types.HelloResponse" {
+		t.Errorf("want the message types resolved, have %+v", route)
+	}
+
+	// Declared types are kept
+	declared := Route{Service: "grpc_types.Unknown", RPC: "Call", Request: "a.Request", Response: "a.Response"}
+	if route, err := transcoder.Resolve(declared); err != nil || !reflect.DeepEqual(route, declared) {
+		t.Errorf("want the declared route unchanged, have %+v %v", route, err)
+	}
+
+	if _, err := transcoder.Resolve(Route{Service: "grpc_types.Hello", RPC: "SayGoodbye"}); err == nil {
+		t.Error("want an unknown method rejected")
+	}
+}
+
+func TestTranscoderAnnotatedRoutes(t *testing.T) {
+	transcoder := NewTranscoder()
+	if err := transcoder.RegisterFile(testAnnotatedFile(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Route{
+		{
+			Method:   "GET",
+			Path:     "/v1/greetings/{name}",
+			Service:  "test.Greeter",
+			RPC:      "Greet",
+			Request:  "grpc_types.HelloRequest",
+			Response: "grpc_types.HelloResponse",
+			Fields:   map[string]string{"name": "name"},
+		},
+		{
+			Method:   "POST",
+			Path:     "/v1/greetings",
+			Service:  "test.Greeter",
+			RPC:      "Greet",
+			Request:  "grpc_types.HelloRequest",
+			Response: "grpc_types.HelloResponse",
+			Body:     "*",
+			Fields:   map[string]string{},
+		},
+		{
+			Method:   "HEAD",
+			Path:     "/v1/greetings/{name}",
+			Service:  "test.Greeter",
+			RPC:      "Greet",
+			Request:  "grpc_types.HelloRequest",
+			Response: "grpc_types.HelloResponse",
+			Fields:   map[string]string{"name": "name"},
+		},
+	}
+	if have := transcoder.AnnotatedRoutes(); !reflect.DeepEqual(have, want) {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+}
+
+func TestTranscoderRPCRoutes(t *testing.T) {
+	transcoder := NewTranscoder()
+	if err := transcoder.RegisterFile(testAnnotatedFile(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Route{
+		{Method: "POST", Path: "/rpc/test.Greeter/Greet", Service: "test.Greeter", RPC: "Greet", Request: "grpc_types.HelloRequest", Response: "grpc_types.HelloResponse", Body: "*"},
+		{Method: "POST", Path: "/rpc/test.Greeter/GreetAll", Service: "test.Greeter", RPC: "GreetAll", Request: "grpc_types.HelloRequest", Response: "grpc_types.HelloResponse", Body: "*"},
+	}
+	if have := transcoder.RPCRoutes("/rpc/"); !reflect.DeepEqual(have, want) {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+
+	// Registering the file again is a no-op
+	if err := transcoder.RegisterFile(testAnnotatedFile(t)); err != nil || len(transcoder.Methods()) != 2 {
+		t.Errorf("want 2 methods, have %d %v", len(transcoder.Methods()), err)
+	}
+}
+
+// testAnnotatedFile returns a gzipped file descriptor of a test.Greeter
+// service, its methods taking the grpc_types greeting messages:
+//
+//	rpc Greet(HelloRequest) returns (HelloResponse) {
+//	  option (google.api.http) = {
+//	    get: "/v1/greetings/{name}"
+//	    additional_bindings { post: "/v1/greetings" body: "*" }
+//	    additional_bindings { get: "/v1/{name=greetings/*}" }
+//	    additional_bindings { get: "/v1/greetings/**" }
+//	    additional_bindings { custom { kind: "head" path: "/v1/greetings/{name}" } }
+//	  };
+//	}
+//	rpc GreetAll(HelloRequest) returns (HelloResponse);
+//	rpc GreetStream(HelloRequest) returns (stream HelloResponse);
+func testAnnotatedFile(t *testing.T) []byte {
+	rule := &annotations.HttpRule{
+		Pattern: &annotations.HttpRule_Get{Get: "/v1/greetings/{name}"},
+		AdditionalBindings: []*annotations.HttpRule{
+			{Pattern: &annotations.HttpRule_Post{Post: "/v1/greetings"}, Body: "*"},
+			{Pattern: &annotations.HttpRule_Get{Get: "/v1/{name=greetings/*}"}},
+			{Pattern: &annotations.HttpRule_Get{Get: "/v1/greetings/**"}},
+			{Pattern: &annotations.HttpRule_Custom{Custom: &annotations.CustomHttpPattern{Kind: "head", Path: "/v1/greetings/{name}"}}},
+		},
+	}
+	options := &protobuf.MethodOptions{}
+	if err := proto.SetExtension(options, annotations.E_Http, rule); err != nil {
+		t.Fatal(err)
+	}
+
+	fd := &protobuf.FileDescriptorProto{
+		Name:    proto.String("test/greeter.proto"),
+		Package: proto.String("test"),
+		Service: []*protobuf.ServiceDescriptorProto{{
+			Name: proto.String("Greeter"),
+			Method: []*protobuf.MethodDescriptorProto{
+				{Name: proto.String("Greet"), InputType: proto.String(".grpc_types.HelloRequest"), OutputType: proto.String(".grpc_types.HelloResponse"), Options: options},
+				{Name: proto.String("GreetAll"), InputType: proto.String(".grpc_types.HelloRequest"), OutputType: proto.String(".grpc_types.HelloResponse")},
+				{Name: proto.String("GreetStream"), InputType: proto.String(".grpc_types.HelloRequest"), OutputType: proto.String(".grpc_types.HelloResponse"), ServerStreaming: proto.Bool(true)},
+			},
+		}},
+	}
+	b, err := proto.Marshal(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
@@ -6,6 +6,7 @@ package addsvc
 import (
 	"context"
 
+	kitjwt "github.com/go-kit/kit/auth/jwt"
 	"github.com/go-kit/kit/log"
 	oldcontext "golang.org/x/net/context"
 	//"github.com/go-kit/kit/tracing/opentracing"
@@ -16,21 +17,61 @@ import (
 )
 
 func MakeAllServicesGRPCServer(endpoints Endpoints, tracer stdopentracing.Tracer, logger log.Logger) grpc_types.GlobalAPIServer {
-	//options := []grpctransport.ServerOption{
-	//	grpctransport.ServerErrorLogger(logger),
-	//}
+	options := []grpctransport.ServerOption{
+		grpctransport.ServerErrorLogger(logger),
+		grpctransport.ServerBefore(kitjwt.GRPCToContext()),
+		grpctransport.ServerBefore(APIKeyGRPCToContext()),
+		grpctransport.ServerBefore(IdempotencyKeyGRPCToContext()),
+		grpctransport.ServerBefore(PriorityGRPCToContext()),
+	}
 	return &grpcAllServicesServer{
 		sayhello: grpctransport.NewServer(
 			endpoints.SayHelloEndpoint,
 			DecodeGRPCSayHelloRequest,
 			EncodeGRPCSayHelloResponse,
-			//append(options, grpctransport.ServerBefore(opentracing.FromGRPCRequest(tracer, "Sum", logger)))...,
+			options...,
 		),
 		sayworld: grpctransport.NewServer(
 			endpoints.SayWorldEndpoint,
-			DecodeGRPCSayHelloRequest,
-			EncodeGRPCSayHelloResponse,
-			//append(options, grpctransport.ServerBefore(opentracing.FromGRPCRequest(tracer, "Sum", logger)))...,
+			DecodeGRPCSayWorldRequest,
+			EncodeGRPCSayWorldResponse,
+			options...,
+		),
+		getavailableagents: grpctransport.NewServer(
+			endpoints.GetAvailableAgentsEndpoint,
+			DecodeGRPCGetAvailableAgentsRequest,
+			EncodeGRPCGetAvailableAgentsResponse,
+			options...,
+		),
+		getagentidfromref: grpctransport.NewServer(
+			endpoints.GetAgentIDFromRefEndpoint,
+			DecodeGRPCGetAgentIDFromRefRequest,
+			EncodeGRPCGetAgentIDFromRefResponse,
+			options...,
+		),
+		acceptcall: grpctransport.NewServer(
+			endpoints.AcceptCallEndpoint,
+			DecodeGRPCAcceptCallRequest,
+			EncodeGRPCAcceptCallResponse,
+			options...,
+		),
+		heartbeat: grpctransport.NewServer(
+			endpoints.HeartBeatEndpoint,
+			DecodeGRPCHeartBeatRequest,
+			EncodeGRPCHeartBeatResponse,
+			options...,
+		),
+		addtask: grpctransport.NewServer(
+			endpoints.AddTaskEndpoint,
+			DecodeGRPCAddTaskRequest,
+			EncodeGRPCAddTaskResponse,
+			options...,
+		),
+		ping: grpctransport.NewServer(
+			endpoints.PingEndpoint,
+			DecodeGRPCPingRequest,
+			EncodeGRPCPingResponse,
+			options...,
 		),
 	}
 }
@@ -48,7 +89,7 @@ type grpcAllServicesServer struct {
 
 // -- Hello Service
 func (s *grpcAllServicesServer) Ping(ctx oldcontext.Context, req *grpc_types.PingRequest) (*grpc_types.PingResponse, error) {
-	_, rep, err := s.getavailableagents.ServeGRPC(ctx, req)
+	_, rep, err := s.ping.ServeGRPC(ctx, req)
 
 	if err != nil {
 		return nil, err
@@ -131,5 +172,109 @@ func DecodeGRPCSayHelloRequest(_ context.Context, grpcReq interface{}) (interfac
 
 func EncodeGRPCSayHelloResponse(_ context.Context, response interface{}) (interface{}, error) {
 	resp := response.(sayHelloResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
 	return &grpc_types.HelloResponse{Message: resp.Message}, nil
 }
+
+// -- World Service
+
+// Decode SayWorld response i.e from world service to go-kit structure endpoint
+func DecodeGRPCSayWorldResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*grpc_types.WorldResponse)
+	return sayWorldResponse{Message: reply.Message}, nil
+}
+
+func DecodeGRPCSayWorldRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*grpc_types.WorldRequest)
+	return sayWorldRequest{Name: req.Name}, nil
+}
+
+func EncodeGRPCSayWorldResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(sayWorldResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &grpc_types.WorldResponse{Message: resp.Message}, nil
+}
+
+// -- Agent Management Service
+
+func DecodeGRPCGetAvailableAgentsRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*grpc_types.GetAvailableAgentsRequest)
+	return getAvailableAgentsRequest{Request: req}, nil
+}
+
+func EncodeGRPCGetAvailableAgentsResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(getAvailableAgentsResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return resp.Response, nil
+}
+
+func DecodeGRPCGetAgentIDFromRefRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*grpc_types.GetAgentIDFromRefRequest)
+	return getAgentIDFromRefRequest{Request: req}, nil
+}
+
+func EncodeGRPCGetAgentIDFromRefResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(getAgentIDFromRefResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return resp.Response, nil
+}
+
+func DecodeGRPCAcceptCallRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*grpc_types.AcceptCallRequest)
+	return acceptCallRequest{Request: req}, nil
+}
+
+func EncodeGRPCAcceptCallResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(acceptCallResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return resp.Response, nil
+}
+
+func DecodeGRPCHeartBeatRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*grpc_types.HeartBeatRequest)
+	return heartBeatRequest{Request: req}, nil
+}
+
+func EncodeGRPCHeartBeatResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(heartBeatResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return resp.Response, nil
+}
+
+func DecodeGRPCAddTaskRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*grpc_types.AddTaskRequest)
+	return addTaskRequest{Request: req}, nil
+}
+
+func EncodeGRPCAddTaskResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(addTaskResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return resp.Response, nil
+}
+
+func DecodeGRPCPingRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*grpc_types.PingRequest)
+	return pingRequest{Request: req}, nil
+}
+
+func EncodeGRPCPingResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(pingResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return resp.Response, nil
+}
@@ -0,0 +1,211 @@
+package addsvc
+
+// This file provides a transparent gRPC reverse proxy. Requests for services
+// not registered on a grpc.Server are forwarded as raw frames to an instance
+// of the backend, so any (unary or streaming) method in the mesh can be reached
+// through the gateway without the gateway knowing its message types.
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/transport"
+)
+
+// proxyFrame holds the undecoded bytes of a single gRPC message.
+type proxyFrame struct {
+	payload []byte
+}
+
+// proxyCodec passes proxyFrame payloads through untouched and falls back to
+// protobuf for every other message, so that services registered on the same
+// grpc.Server keep working.
+type proxyCodec struct{}
+
+// ProxyCodec returns the codec the proxy relies on. It must be installed on
+// both the grpc.Server (grpc.CustomCodec) and the backend grpc.ClientConn
+// (grpc.WithCodec) used by MakeGRPCProxyHandler.
+func ProxyCodec() grpc.Codec {
+	return proxyCodec{}
+}
+
+func (proxyCodec) Marshal(v interface{}) ([]byte, error) {
+	if frame, ok := v.(*proxyFrame); ok {
+		return frame.payload, nil
+	}
+	return proto.Marshal(v.(proto.Message))
+}
+
+func (proxyCodec) Unmarshal(data []byte, v interface{}) error {
+	if frame, ok := v.(*proxyFrame); ok {
+		frame.payload = data
+		return nil
+	}
+	return proto.Unmarshal(data, v.(proto.Message))
+}
+
+// String must be "proto" so that the backend sees the usual
+// application/grpc+proto content type.
+func (proxyCodec) String() string {
+	return "proto"
+}
+
+// MakeGRPCProxyHandler returns a handler, to be used with
+// grpc.UnknownServiceHandler, that forwards every call to a service in
+// allowed to an instance of that service, which must be dialed with
+// ProxyCodec. Metadata is passed through in both directions. An allowed entry
+// of "*" allows any service. Calls to other services are rejected with
+// codes.Unimplemented, as if the proxy was not there.
+func MakeGRPCProxyHandler(backends *Backends, allowed []string, logger log.Logger) grpc.StreamHandler {
+	allowAll := false
+	allowedServices := map[string]bool{}
+	for _, service := range allowed {
+		if service == "*" {
+			allowAll = true
+		}
+		allowedServices[service] = true
+	}
+
+	return func(_ interface{}, serverStream grpc.ServerStream) (err error) {
+		stream, ok := transport.StreamFromContext(serverStream.Context())
+		if !ok {
+			return status.Error(codes.Internal, "gRPC proxy: no method in the server stream")
+		}
+		fullMethod := stream.Method()
+
+		service := strings.TrimPrefix(fullMethod, "/")
+		if i := strings.Index(service, "/"); i >= 0 {
+			service = service[:i]
+		}
+		if !allowAll && !allowedServices[service] {
+			logger.Log("level", "warn", "msg", "rejected call to a service not in the allowlist", "method", fullMethod)
+			return status.Errorf(codes.Unimplemented, "unknown service %s", service)
+		}
+
+		backend, err := backends.Get(service)
+		if err != nil {
+			return status.Errorf(codes.Unavailable, "gRPC proxy: %v", err)
+		}
+		connection, done, err := backend.Pick(serverStream.Context())
+		if err != nil {
+			return err
+		}
+		defer func() { done(err) }()
+
+		ctx, cancel := context.WithCancel(serverStream.Context())
+		defer cancel()
+
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			ctx = metadata.NewOutgoingContext(ctx, proxyMetadata(md))
+		}
+
+		clientStream, err := grpc.NewClientStream(
+			ctx,
+			&grpc.StreamDesc{ServerStreams: true, ClientStreams: true},
+			connection,
+			fullMethod,
+		)
+		if err != nil {
+			return err
+		}
+
+		s2c := forwardServerToClient(serverStream, clientStream)
+		c2s := forwardClientToServer(clientStream, serverStream)
+
+		// Wait for the backend to finish the call. The caller finishing first
+		// (io.EOF) only half-closes the backend stream.
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-s2c:
+				if err == io.EOF {
+					clientStream.CloseSend()
+					continue
+				}
+				cancel()
+				return status.Errorf(codes.Internal, "gRPC proxy: failed forwarding to backend: %v", err)
+
+			case err := <-c2s:
+				serverStream.SetTrailer(clientStream.Trailer())
+				if err != io.EOF {
+					// Already a status error from the backend
+					return err
+				}
+				return nil
+			}
+		}
+
+		return status.Error(codes.Internal, "gRPC proxy: backend stream did not finish")
+	}
+}
+
+// proxyMetadata copies the incoming metadata, dropping HTTP/2 pseudo headers
+// and the ones set by the gRPC transport itself.
+func proxyMetadata(md metadata.MD) metadata.MD {
+	out := metadata.MD{}
+	for k, v := range md {
+		if strings.HasPrefix(k, ":") || k == "content-type" || k == "user-agent" || k == "te" {
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// forwardServerToClient forwards the caller's messages to the backend.
+func forwardServerToClient(src grpc.ServerStream, dst grpc.ClientStream) chan error {
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			frame := &proxyFrame{}
+			if err := src.RecvMsg(frame); err != nil {
+				errc <- err // io.EOF once the caller is done sending
+				return
+			}
+			if err := dst.SendMsg(frame); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	return errc
+}
+
+// forwardClientToServer forwards the backend's header and messages to the
+// caller.
+func forwardClientToServer(src grpc.ClientStream, dst grpc.ServerStream) chan error {
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			frame := &proxyFrame{}
+			if err := src.RecvMsg(frame); err != nil {
+				errc <- err // io.EOF on success, the status error otherwise
+				return
+			}
+			if i == 0 {
+				// The header is only available once the first message has
+				// arrived.
+				md, err := src.Header()
+				if err != nil {
+					errc <- err
+					return
+				}
+				if err := dst.SendHeader(md); err != nil {
+					errc <- err
+					return
+				}
+			}
+			if err := dst.SendMsg(frame); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	return errc
+}
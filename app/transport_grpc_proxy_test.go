@@ -0,0 +1,136 @@
+package addsvc
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/newtonsystems/grpc_types/go/grpc_types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// testEchoService is a backend service unknown to the gateway, greeting
+// back with the x-caller metadata of the call.
+var testEchoService = grpc.ServiceDesc{
+	ServiceName: "test.Echo",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Echo",
+		Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := &grpc_types.HelloRequest{}
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			md, _ := metadata.FromIncomingContext(ctx)
+			grpc.SetHeader(ctx, metadata.Pairs("x-backend", "echo"))
+			grpc.SetTrailer(ctx, metadata.Pairs("x-echoed", "1"))
+			return &grpc_types.HelloResponse{Message: "hello " + req.Name + " from " + firstValue(md["x-caller"])}, nil
+		},
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Chat",
+		ServerStreams: true,
+		ClientStreams: true,
+		Handler: func(_ interface{}, stream grpc.ServerStream) error {
+			for {
+				req := &grpc_types.HelloRequest{}
+				if err := stream.RecvMsg(req); err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				if err := stream.SendMsg(&grpc_types.HelloResponse{Message: "hello " + req.Name}); err != nil {
+					return err
+				}
+			}
+		},
+	}},
+}
+
+func firstValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func TestGRPCProxyHandler(t *testing.T) {
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := grpc.NewServer()
+	backend.RegisterService(&testEchoService, struct{}{})
+	go backend.Serve(backendListener)
+	defer backend.Stop()
+
+	backends := NewBackends(StaticDiscovery{"*": {backendListener.Addr().String()}}, DefaultBackendSettings, discard.NewCounter(), log.NewNopLogger(), grpc.WithInsecure(), grpc.WithCodec(ProxyCodec()))
+	defer backends.Close()
+
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := grpc.NewServer(
+		grpc.CustomCodec(ProxyCodec()),
+		grpc.UnknownServiceHandler(MakeGRPCProxyHandler(backends, []string{"test.Echo"}, log.NewNopLogger())),
+	)
+	go proxy.Serve(proxyListener)
+	defer proxy.Stop()
+
+	conn, err := grpc.Dial(proxyListener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("x-caller", "bob"))
+
+	// Metadata is passed through both ways
+	var header, trailer metadata.MD
+	resp := &grpc_types.HelloResponse{}
+	if err := grpc.Invoke(ctx, "/test.Echo/Echo", &grpc_types.HelloRequest{Name: "alice"}, resp, conn, grpc.Header(&header), grpc.Trailer(&trailer)); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Message != "hello alice from bob" {
+		t.Errorf("want the caller metadata forwarded, have %q", resp.Message)
+	}
+	if firstValue(header["x-backend"]) != "echo" || firstValue(trailer["x-echoed"]) != "1" {
+		t.Errorf("want the backend header and trailer, have %v and %v", header, trailer)
+	}
+
+	// Services not in the allowlist are unknown
+	err = grpc.Invoke(ctx, "/test.Other/Echo", &grpc_types.HelloRequest{Name: "alice"}, resp, conn)
+	if grpc.Code(err) != codes.Unimplemented {
+		t.Errorf("want Unimplemented, have %v", err)
+	}
+
+	// Streams are forwarded message by message
+	stream, err := grpc.NewClientStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, conn, "/test.Echo/Chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"alice", "bob", "carol"}
+	for _, name := range names {
+		if err := stream.SendMsg(&grpc_types.HelloRequest{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+		resp := &grpc_types.HelloResponse{}
+		if err := stream.RecvMsg(resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Message != "hello "+name {
+			t.Errorf("want hello %s, have %q", name, resp.Message)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&grpc_types.HelloResponse{}); err != io.EOF {
+		t.Errorf("want the stream finished, have %v", err)
+	}
+}
@@ -4,44 +4,192 @@ package addsvc
 // It utilizes the transport/http.Server.
 
 import (
-	//"bytes"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	//"io/ioutil"
+	"math"
 	"net/http"
 
 	//"os"
+	"strconv"
 	"strings"
-	//stdopentracing "github.com/opentracing/opentracing-go"
-	//"github.com/go-kit/kit/log"
-	//"github.com/go-kit/kit/tracing/opentracing"
-	//httptransport "github.com/go-kit/kit/transport/http"
-)
 
-// Business-domain errors like these may be served in two ways: returned
-// directly by endpoints, or bundled into the response struct. Both methods can
-// be made to work, but errors returned directly by endpoints are counted by
-// middlewares that check errors, like circuit breakers.
-//
-// If you don't want that behavior -- and you probably don't -- then it's better
-// to bundle errors into the response struct.
-
-var (
-	// ErrTwoZeroes is an arbitrary business rule for the Add method.
-	ErrTwoZeroes = errors.New("can't sum two zeroes")
-
-	// ErrIntOverflow protects the Add method. We've decided that this error
-	// indicates a misbehaving service and should count against e.g. circuit
-	// breakers. So, we return it directly in endpoints, to illustrate the
-	// difference. In a real service, this probably wouldn't be the case.
-	ErrIntOverflow = errors.New("integer overflow")
-
-	// ErrMaxSizeExceeded protects the Concat method.
-	ErrMaxSizeExceeded = errors.New("result exceeds maximum size")
+	kitjwt "github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/tracing/opentracing"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/newtonsystems/grpc_types/go/grpc_types"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// maxRequestBodySize caps the size of a JSON body accepted by the public HTTP
+// gateway.
+const maxRequestBodySize = 1 << 20
+
+// MakeHTTPHandler returns a handler that makes a set of endpoints available on
+// versioned paths. Unlike MakeDebugHTTPHandler it is safe to expose publicly:
+// it only serves the routes below, restricts the HTTP method of each route,
+// limits the request body size and never logs request headers.
+func MakeHTTPHandler(endpoints Endpoints, tracer stdopentracing.Tracer, logger log.Logger) http.Handler {
+	options := []httptransport.ServerOption{
+		httptransport.ServerErrorEncoder(errorEncoder),
+		httptransport.ServerErrorLogger(logger),
+		httptransport.ServerBefore(kitjwt.HTTPToContext()),
+		httptransport.ServerBefore(APIKeyHTTPToContext()),
+		httptransport.ServerBefore(RequestTimeoutHTTPToContext()),
+		httptransport.ServerBefore(IdempotencyKeyHTTPToContext()),
+		httptransport.ServerBefore(PriorityHTTPToContext()),
+		httptransport.ServerBefore(httptransport.PopulateRequestContext),
+	}
+
+	route := func(e endpoint.Endpoint, dec httptransport.DecodeRequestFunc, operationName string) http.Handler {
+		return limitRequestBody(httptransport.NewServer(
+			e,
+			dec,
+			EncodeHTTPGenericResponse,
+			append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, operationName, logger)))...,
+		))
+	}
+
+	m := http.NewServeMux()
+
+	// Hello & World services
+	m.Handle("/v1/hello", allowMethods(route(endpoints.SayHelloEndpoint, decodeHTTPSayHelloRequest, "SayHello"), "POST"))
+	m.Handle("/v1/world", allowMethods(route(endpoints.SayWorldEndpoint, decodeHTTPSayWorldRequest, "SayWorld"), "POST"))
+
+	// Agent management service
+	m.Handle("/v1/agents", allowMethods(route(endpoints.GetAvailableAgentsEndpoint, decodeHTTPGetAvailableAgentsRequest, "GetAvailableAgents"), "GET", "POST"))
+	m.Handle("/v1/agents/id", allowMethods(route(endpoints.GetAgentIDFromRefEndpoint, decodeHTTPGetAgentIDFromRefRequest, "GetAgentIDFromRef"), "POST"))
+	m.Handle("/v1/agents/heartbeat", allowMethods(route(endpoints.HeartBeatEndpoint, decodeHTTPHeartBeatRequest, "HeartBeat"), "POST"))
+	m.Handle("/v1/calls/accept", allowMethods(route(endpoints.AcceptCallEndpoint, decodeHTTPAcceptCallRequest, "AcceptCall"), "POST"))
+	m.Handle("/v1/tasks", allowMethods(route(endpoints.AddTaskEndpoint, decodeHTTPAddTaskRequest, "AddTask"), "POST"))
+	m.Handle("/v1/ping", allowMethods(route(endpoints.PingEndpoint, decodeHTTPPingRequest, "Ping"), "GET", "POST"))
+
+	return m
+}
+
+// allowMethods wraps a handler so that any HTTP method other than the ones
+// given is rejected with 405 Method Not Allowed.
+func allowMethods(next http.Handler, methods ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range methods {
+			if r.Method == method {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		writeMethodNotAllowed(w, methods)
+	})
+}
+
+// writeMethodNotAllowed answers 405 Method Not Allowed with the allowed
+// methods. No gRPC code maps onto 405, so the body deliberately reports
+// Unimplemented, the code gRPC gives an unknown method, although
+// HTTPStatusFromCode maps Unimplemented to 501. Clients must go by the status
+// line here.
+func writeMethodNotAllowed(w http.ResponseWriter, allowed []string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	json.NewEncoder(w).Encode(errorWrapper{Code: codes.Unimplemented.String(), Message: "method not allowed"})
+}
+
+// limitRequestBody wraps a handler so that reading more than
+// maxRequestBodySize bytes of the request body fails, and the connection is
+// closed once the response is written.
+func limitRequestBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errRequestBodyTooLarge is returned for a request body exceeding
+// maxRequestBodySize. errorEncoder serves it as 413 Request Entity Too Large,
+// the body reporting InvalidArgument as no gRPC code maps onto 413.
+var errRequestBodyTooLarge = status.Errorf(codes.InvalidArgument, "request body larger than %d bytes", maxRequestBodySize)
+
+// bodyDecodeError returns the error of a request decoder failing to decode
+// the body with err.
+func bodyDecodeError(err error) error {
+	if _, ok := err.(*http.MaxBytesError); ok {
+		return errRequestBodyTooLarge
+	}
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+// decodeLimitedJSONBody decodes a JSON request body, limited by
+// limitRequestBody, into v. An empty body is not an error, so that GET routes
+// can be served without one.
+func decodeLimitedJSONBody(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return bodyDecodeError(err)
+	}
+	return nil
+}
+
+func decodeHTTPSayHelloRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req sayHelloRequest
+	err := decodeLimitedJSONBody(r, &req)
+	return req, err
+}
+
+func decodeHTTPSayWorldRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req sayWorldRequest
+	err := decodeLimitedJSONBody(r, &req)
+	return req, err
+}
+
+func decodeHTTPGetAvailableAgentsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := getAvailableAgentsRequest{Request: &grpc_types.GetAvailableAgentsRequest{}}
+	err := decodeLimitedJSONBody(r, req.Request)
+	return req, err
+}
+
+func decodeHTTPGetAgentIDFromRefRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := getAgentIDFromRefRequest{Request: &grpc_types.GetAgentIDFromRefRequest{}}
+	err := decodeLimitedJSONBody(r, req.Request)
+	return req, err
+}
+
+func decodeHTTPAcceptCallRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := acceptCallRequest{Request: &grpc_types.AcceptCallRequest{}}
+	err := decodeLimitedJSONBody(r, req.Request)
+	return req, err
+}
+
+func decodeHTTPHeartBeatRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := heartBeatRequest{Request: &grpc_types.HeartBeatRequest{}}
+	err := decodeLimitedJSONBody(r, req.Request)
+	return req, err
+}
+
+func decodeHTTPAddTaskRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := addTaskRequest{Request: &grpc_types.AddTaskRequest{}}
+	err := decodeLimitedJSONBody(r, req.Request)
+	return req, err
+}
+
+func decodeHTTPPingRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := pingRequest{Request: &grpc_types.PingRequest{}}
+	err := decodeLimitedJSONBody(r, req.Request)
+	return req, err
+}
+
 func formatRequest(r *http.Request) string {
 	// Create return string
 	var reqstr []string
@@ -86,17 +234,112 @@ func getRequestAdvancedInfoArgs(req *http.Request) []interface{} {
 	}
 }
 
+// errorEncoder writes err as a structured JSON error body. The HTTP status
+// is derived from the gRPC status code of err, so that errors returned by the
+// backends keep their meaning i.e. NotFound is served as 404. ResourceExhausted
+// is served as 429, unless it is about a gateway resource (a ResourceInfo
+// detail) rather than the caller's quota, which is served as 503. A request
+// body too large is served as 413.
 func errorEncoder(_ context.Context, err error, w http.ResponseWriter) {
-	code := http.StatusInternalServerError
-	msg := err.Error()
+	s := errorStatus(err)
 
-	switch err {
-	case ErrTwoZeroes, ErrMaxSizeExceeded, ErrIntOverflow:
-		code = http.StatusBadRequest
+	body := errorWrapper{Code: s.Code().String(), Message: s.Message()}
+	for _, detail := range s.Proto().GetDetails() {
+		body.Details = append(body.Details, encodeErrorDetail(detail))
 	}
 
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if s.Code() == codes.Unauthenticated {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	code := HTTPStatusFromCode(s.Code())
+	if err == errRequestBodyTooLarge {
+		code = http.StatusRequestEntityTooLarge
+	}
+	for _, detail := range s.Details() {
+		switch detail := detail.(type) {
+		case *errdetails.RetryInfo:
+			if d, err := ptypes.Duration(detail.GetRetryDelay()); err == nil {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+			}
+		case *errdetails.ResourceInfo:
+			if s.Code() == codes.ResourceExhausted {
+				code = http.StatusServiceUnavailable
+			}
+		}
+	}
 	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(errorWrapper{Error: msg})
+	json.NewEncoder(w).Encode(body)
+}
+
+// errorStatus returns the gRPC status of err. Context errors are mapped to
+// their gRPC counterparts, any other error which is not a gRPC status error
+// is treated as Internal.
+func errorStatus(err error) *status.Status {
+	if s, ok := status.FromError(err); ok {
+		return s
+	}
+
+	switch err {
+	case context.DeadlineExceeded:
+		return status.New(codes.DeadlineExceeded, err.Error())
+	case context.Canceled:
+		return status.New(codes.Canceled, err.Error())
+	}
+	return status.New(codes.Internal, err.Error())
+}
+
+// encodeErrorDetail encodes a google.rpc.Status detail using the protobuf JSON
+// mapping. Details of a type not compiled into the gateway are reduced to
+// their type URL.
+func encodeErrorDetail(detail *any.Any) json.RawMessage {
+	var buf bytes.Buffer
+	if err := routeMarshaler.Marshal(&buf, detail); err != nil {
+		b, _ := json.Marshal(map[string]string{"@type": detail.GetTypeUrl()})
+		return b
+	}
+	return buf.Bytes()
+}
+
+// HTTPStatusFromCode returns the HTTP status code matching a gRPC status code.
+func HTTPStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499 // Client Closed Request
+	case codes.Unknown:
+		return http.StatusInternalServerError
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.FailedPrecondition:
+		return http.StatusBadRequest
+	case codes.Aborted:
+		return http.StatusConflict
+	case codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Internal:
+		return http.StatusInternalServerError
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DataLoss:
+		return http.StatusInternalServerError
+	}
+	return http.StatusInternalServerError
 }
 
 func errorDecoder(r *http.Response) error {
@@ -104,15 +347,31 @@ func errorDecoder(r *http.Response) error {
 	if err := json.NewDecoder(r.Body).Decode(&w); err != nil {
 		return err
 	}
-	return errors.New(w.Error)
+	return errors.New(w.Message)
 }
 
+// errorWrapper is the JSON error body served by the HTTP transports. Code is
+// the name of the gRPC status code i.e. "NotFound".
 type errorWrapper struct {
-	Error string `json:"error"`
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Details []json.RawMessage `json:"details,omitempty"`
 }
 
 // EncodeHTTPGenericResponse is a transport/http.EncodeResponseFunc that encodes
-// the response as JSON to the response writer. Primarily useful in a server.
-func EncodeHTTPGenericResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+// the response as JSON to the response writer. Responses wrapping a backend
+// reply are encoded as the reply alone, with the protobuf JSON mapping, so
+// that they look the same as the replies of the route table. Responses
+// carrying a business error (see Failer) are encoded as an error payload
+// instead. Primarily useful in a server.
+func EncodeHTTPGenericResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if f, ok := response.(Failer); ok && f.Failed() != nil {
+		errorEncoder(ctx, f.Failed(), w)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if p, ok := response.(protoResponder); ok {
+		return routeMarshaler.Marshal(w, p.protoMessage())
+	}
 	return json.NewEncoder(w).Encode(response)
 }
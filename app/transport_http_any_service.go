@@ -8,10 +8,13 @@ import (
 	"encoding/json"
 	"net/http"
 
+	kitjwt "github.com/go-kit/kit/auth/jwt"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/tracing/opentracing"
 	httptransport "github.com/go-kit/kit/transport/http"
 	stdopentracing "github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var main_logger log.Logger
@@ -21,6 +24,11 @@ func MakeDebugHTTPHandler(endpoints Endpoints, tracer stdopentracing.Tracer, log
 	options := []httptransport.ServerOption{
 		httptransport.ServerErrorEncoder(errorEncoder),
 		httptransport.ServerErrorLogger(logger),
+		httptransport.ServerBefore(kitjwt.HTTPToContext()),
+		httptransport.ServerBefore(APIKeyHTTPToContext()),
+		httptransport.ServerBefore(RequestTimeoutHTTPToContext()),
+		httptransport.ServerBefore(IdempotencyKeyHTTPToContext()),
+		httptransport.ServerBefore(PriorityHTTPToContext()),
 	}
 
 	main_logger = logger
@@ -32,6 +40,12 @@ func MakeDebugHTTPHandler(endpoints Endpoints, tracer stdopentracing.Tracer, log
 		EncodeHTTPGenericResponse,
 		append(options, httptransport.ServerBefore(httptransport.PopulateRequestContext), httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "SayHello", logger)))...,
 	))
+	m.Handle("/sayworld", httptransport.NewServer(
+		endpoints.SayWorldEndpoint,
+		DecodeHTTPSayWorldRequest,
+		EncodeHTTPGenericResponse,
+		append(options, httptransport.ServerBefore(httptransport.PopulateRequestContext), httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "SayWorld", logger)))...,
+	))
 
 	return m
 }
@@ -41,6 +55,19 @@ func MakeDebugHTTPHandler(endpoints Endpoints, tracer stdopentracing.Tracer, log
 func DecodeHTTPSayHelloRequest(ctx context.Context, r *http.Request) (interface{}, error) {
 	main_logger.Log(getRequestInfoArgs(r)...)
 	var req sayHelloRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
-	return req, err
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return req, nil
+}
+
+// -- SayWorld
+
+func DecodeHTTPSayWorldRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	main_logger.Log(getRequestInfoArgs(r)...)
+	var req sayWorldRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return req, nil
 }
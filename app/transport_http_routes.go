@@ -0,0 +1,374 @@
+package addsvc
+
+// This file provides a declarative route table for the HTTP transport. Each
+// route maps an HTTP method and path template onto a backend gRPC method, so
+// that a new backend RPC can be exposed by editing the route table file
+// rather than the gateway code.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	kitjwt "github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/tracing/opentracing"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Route declares how an HTTP request is mapped onto a backend gRPC method.
+//
+// Path is a template such as "/v1/agents/{id}". Fields maps a path or query
+// parameter name to the JSON name of the request message field it is copied
+// into, e.g. { id = "agent_id" }. Path parameters win over query parameters,
+// and both win over fields given in the JSON body.
+//
+// Request and Response may be left empty, in which case they are resolved
+// from the service descriptor by Transcoder.Resolve. Body follows the
+// google.api.http convention: empty or "*" decodes the JSON body into the
+// whole request message, anything else names the request field it is
+// decoded into.
+type Route struct {
+	Method   string            `toml:"method"`
+	Path     string            `toml:"path"`
+	Service  string            `toml:"service"`
+	RPC      string            `toml:"rpc"`
+	Request  string            `toml:"request"`
+	Response string            `toml:"response"`
+	Body     string            `toml:"body"`
+	Fields   map[string]string `toml:"fields"`
+	Priority string            `toml:"priority"`
+}
+
+// FullMethod returns the gRPC method name of the route i.e.
+// /grpc_types.Hello/SayHello
+func (r Route) FullMethod() string {
+	return "/" + r.Service + "/" + r.RPC
+}
+
+// RouteTable is the set of routes served by the route table HTTP handler, in
+// order of precedence.
+type RouteTable struct {
+	Routes []Route `toml:"route"`
+}
+
+// LoadRouteTable reads and validates a TOML route table file.
+func LoadRouteTable(filename string) (RouteTable, error) {
+	var table RouteTable
+	if _, err := toml.DecodeFile(filename, &table); err != nil {
+		return RouteTable{}, err
+	}
+
+	for i, route := range table.Routes {
+		if route.Method == "" || route.Path == "" || route.Service == "" || route.RPC == "" {
+			return RouteTable{}, fmt.Errorf("route %d: method, path, service and rpc are required", i)
+		}
+		if !strings.HasPrefix(route.Path, "/") {
+			return RouteTable{}, fmt.Errorf("route %d: path %q must start with /", i, route.Path)
+		}
+		if route.Priority != "" {
+			if _, err := ParsePriority(route.Priority); err != nil {
+				return RouteTable{}, fmt.Errorf("route %d: %v", i, err)
+			}
+		}
+		table.Routes[i].Method = strings.ToUpper(route.Method)
+	}
+
+	return table, nil
+}
+
+// MakeRouteEndpoint returns an endpoint that invokes the route's gRPC method
+// on an instance of the given backend. The request and response message types
+// are looked up in the protobuf registry, so any message type compiled into
+// the gateway (i.e. everything in grpc_types) can be used.
+func MakeRouteEndpoint(backend *Backend, route Route) (endpoint.Endpoint, error) {
+	responseType := proto.MessageType(route.Response)
+	if responseType == nil {
+		return nil, fmt.Errorf("%s: unknown response message type %q", route.FullMethod(), route.Response)
+	}
+
+	method := route.FullMethod()
+
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(routeRequest)
+
+		connection, done, err := backend.Pick(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := reflect.New(responseType.Elem()).Interface().(proto.Message)
+		err = grpc.Invoke(ctx, method, req.Message, resp, connection)
+		done(err)
+		if err != nil {
+			if !isBusinessError(err) {
+				return nil, err
+			}
+			return routeResponse{Err: err}, nil
+		}
+
+		return routeResponse{Message: resp}, nil
+	}, nil
+}
+
+// MakeRouteTableHTTPHandler returns a handler serving every route of the
+// table, over the instances of the backend service of each route. Each route
+// endpoint is wrapped by middleware (which may be nil), so that callers can
+// add the same instrumentation the static endpoints get. Requests not
+// matching any route are passed on to next.
+func MakeRouteTableHTTPHandler(table RouteTable, backends *Backends, middleware func(Route, endpoint.Endpoint) endpoint.Endpoint, next http.Handler, tracer stdopentracing.Tracer, logger log.Logger) (http.Handler, error) {
+	options := []httptransport.ServerOption{
+		httptransport.ServerErrorEncoder(errorEncoder),
+		httptransport.ServerErrorLogger(logger),
+		httptransport.ServerBefore(kitjwt.HTTPToContext()),
+		httptransport.ServerBefore(APIKeyHTTPToContext()),
+		httptransport.ServerBefore(RequestTimeoutHTTPToContext()),
+		httptransport.ServerBefore(IdempotencyKeyHTTPToContext()),
+		httptransport.ServerBefore(PriorityHTTPToContext()),
+		httptransport.ServerBefore(httptransport.PopulateRequestContext),
+	}
+
+	h := &routeTableHandler{next: next}
+	for _, route := range table.Routes {
+		requestType := proto.MessageType(route.Request)
+		if requestType == nil {
+			return nil, fmt.Errorf("%s: unknown request message type %q", route.FullMethod(), route.Request)
+		}
+		for _, field := range route.Fields {
+			if messageFieldIndex(requestType.Elem(), field) < 0 {
+				return nil, fmt.Errorf("%s: %s has no field %q", route.FullMethod(), route.Request, field)
+			}
+		}
+		if route.Body != "" && route.Body != "*" {
+			i := messageFieldIndex(requestType.Elem(), route.Body)
+			if i < 0 || !requestType.Elem().Field(i).Type.Implements(reflect.TypeOf((*proto.Message)(nil)).Elem()) {
+				return nil, fmt.Errorf("%s: %s has no message field %q for the body", route.FullMethod(), route.Request, route.Body)
+			}
+		}
+
+		backend, err := backends.Get(route.Service)
+		if err != nil {
+			return nil, err
+		}
+		e, err := MakeRouteEndpoint(backend, route)
+		if err != nil {
+			return nil, err
+		}
+		if middleware != nil {
+			e = middleware(route, e)
+		}
+
+		h.routes = append(h.routes, compiledRoute{
+			Route:    route,
+			segments: splitPath(route.Path),
+			handler: limitRequestBody(httptransport.NewServer(
+				e,
+				makeDecodeHTTPRouteRequest(route, requestType),
+				EncodeHTTPRouteResponse,
+				append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, route.RPC, logger)))...,
+			)),
+		})
+	}
+
+	return h, nil
+}
+
+// EncodeHTTPRouteResponse is a transport/http.EncodeResponseFunc that encodes
+// the backend reply of a route as JSON, using the protobuf JSON mapping.
+func EncodeHTTPRouteResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(routeResponse)
+	if resp.Err != nil {
+		errorEncoder(ctx, resp.Err, w)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return routeMarshaler.Marshal(w, resp.Message)
+}
+
+// routeMarshaler uses the original proto field names, matching the names used
+// in route table field mappings and by the rest of the HTTP gateway.
+var routeMarshaler = &jsonpb.Marshaler{OrigName: true, EmitDefaults: true}
+
+type routeRequest struct {
+	Message proto.Message
+}
+
+type routeResponse struct {
+	Message proto.Message
+	Err     error
+}
+
+func (r routeResponse) Failed() error { return r.Err }
+
+type compiledRoute struct {
+	Route
+	segments []string
+	handler  http.Handler
+}
+
+type routeTableHandler struct {
+	routes []compiledRoute
+	next   http.Handler
+}
+
+type routeParamsKey struct{}
+
+func (h *routeTableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := splitPath(r.URL.Path)
+
+	var allowed []string
+	for _, route := range h.routes {
+		params, ok := matchPath(route.segments, segments)
+		if !ok {
+			continue
+		}
+		if route.Method != r.Method {
+			allowed = append(allowed, route.Method)
+			continue
+		}
+
+		ctx := context.WithValue(r.Context(), routeParamsKey{}, params)
+		route.handler.ServeHTTP(w, r.WithContext(ctx))
+		return
+	}
+
+	if len(allowed) > 0 {
+		writeMethodNotAllowed(w, allowed)
+		return
+	}
+
+	if h.next == nil {
+		http.NotFound(w, r)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// matchPath matches request path segments against a route template, returning
+// the values of its {param} segments.
+func matchPath(template, segments []string) (map[string]string, bool) {
+	if len(template) != len(segments) {
+		return nil, false
+	}
+
+	params := map[string]string{}
+	for i, t := range template {
+		if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+			params[t[1:len(t)-1]] = segments[i]
+			continue
+		}
+		if t != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func makeDecodeHTTPRouteRequest(route Route, requestType reflect.Type) httptransport.DecodeRequestFunc {
+	return func(ctx context.Context, r *http.Request) (interface{}, error) {
+		msg := reflect.New(requestType.Elem()).Interface().(proto.Message)
+
+		body := msg
+		if route.Body != "" && route.Body != "*" {
+			f := reflect.ValueOf(msg).Elem().Field(messageFieldIndex(requestType.Elem(), route.Body))
+			f.Set(reflect.New(f.Type().Elem()))
+			body = f.Interface().(proto.Message)
+		}
+
+		err := jsonpb.Unmarshal(r.Body, body)
+		if err != nil && err != io.EOF {
+			return nil, bodyDecodeError(err)
+		}
+
+		params, _ := ctx.Value(routeParamsKey{}).(map[string]string)
+		query := r.URL.Query()
+		for param, field := range route.Fields {
+			value, ok := params[param]
+			if !ok {
+				if _, ok = query[param]; !ok {
+					continue
+				}
+				value = query.Get(param)
+			}
+			if err := setMessageField(msg, field, value); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+		}
+
+		return routeRequest{Message: msg}, nil
+	}
+}
+
+// setMessageField sets the field of a generated protobuf message whose JSON
+// (or original proto) name is name, converting value to the field's type.
+func setMessageField(msg proto.Message, name, value string) error {
+	v := reflect.ValueOf(msg).Elem()
+
+	i := messageFieldIndex(v.Type(), name)
+	if i < 0 {
+		return errors.New("unknown field " + name)
+	}
+
+	f := v.Field(i)
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("field %s: %v", name, err)
+		}
+		f.SetBool(b)
+	case reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, f.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("field %s: %v", name, err)
+		}
+		f.SetInt(n)
+	case reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, f.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("field %s: %v", name, err)
+		}
+		f.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(value, f.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("field %s: %v", name, err)
+		}
+		f.SetFloat(n)
+	default:
+		return fmt.Errorf("field %s: cannot be set from a path or query parameter", name)
+	}
+	return nil
+}
+
+// messageFieldIndex returns the index of the struct field of a generated
+// protobuf message type with the given proto or JSON name, or -1.
+func messageFieldIndex(t reflect.Type, name string) int {
+	for i := 0; i < t.NumField(); i++ {
+		for _, part := range strings.Split(t.Field(i).Tag.Get("protobuf"), ",") {
+			if part == "name="+name || part == "json="+name {
+				return i
+			}
+		}
+	}
+	return -1
+}
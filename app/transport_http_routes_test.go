@@ -0,0 +1,235 @@
+package addsvc
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// testRouteMessage is a protobuf message with a field of each kind that can
+// be set from a path or query parameter.
+type testRouteMessage struct {
+	AgentId string            `protobuf:"bytes,1,opt,name=agent_id,json=agentId" json:"agent_id,omitempty"`
+	Limit   int32             `protobuf:"varint,2,opt,name=limit" json:"limit,omitempty"`
+	Offset  int64             `protobuf:"varint,3,opt,name=offset" json:"offset,omitempty"`
+	Count   uint32            `protobuf:"varint,4,opt,name=count" json:"count,omitempty"`
+	Active  bool              `protobuf:"varint,5,opt,name=active" json:"active,omitempty"`
+	Ratio   float64           `protobuf:"fixed64,6,opt,name=ratio" json:"ratio,omitempty"`
+	Tags    []string          `protobuf:"bytes,7,rep,name=tags" json:"tags,omitempty"`
+	Task    *testRouteMessage `protobuf:"bytes,8,opt,name=task" json:"task,omitempty"`
+}
+
+func (m *testRouteMessage) Reset()         { *m = testRouteMessage{} }
+func (m *testRouteMessage) String() string { return proto.CompactTextString(m) }
+func (*testRouteMessage) ProtoMessage()    {}
+
+func TestLoadRouteTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"valid", `
+			[[route]]
+			method = "get"
+			path = "/v1/hello/{name}"
+			service = "grpc_types.Hello"
+			rpc = "SayHello"
+			priority = "sheddable"
+			fields = { name = "name" }
+		`, ""},
+		{"missing rpc", `
+			[[route]]
+			method = "GET"
+			path = "/v1/hello"
+			service = "grpc_types.Hello"
+		`, "method, path, service and rpc are required"},
+		{"relative path", `
+			[[route]]
+			method = "GET"
+			path = "v1/hello"
+			service = "grpc_types.Hello"
+			rpc = "SayHello"
+		`, "must start with /"},
+		{"invalid priority", `
+			[[route]]
+			method = "GET"
+			path = "/v1/hello"
+			service = "grpc_types.Hello"
+			rpc = "SayHello"
+			priority = "urgent"
+		`, "invalid priority"},
+		{"invalid TOML", `[[route]`, "expected"},
+	} {
+		filename := filepath.Join(dir, strings.Replace(tc.name, " ", "_", -1)+".toml")
+		if err := ioutil.WriteFile(filename, []byte(tc.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		table, err := LoadRouteTable(filename)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: want an error containing %q, have %v", tc.name, tc.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		want := []Route{{
+			Method:   "GET",
+			Path:     "/v1/hello/{name}",
+			Service:  "grpc_types.Hello",
+			RPC:      "SayHello",
+			Priority: "sheddable",
+			Fields:   map[string]string{"name": "name"},
+		}}
+		if !reflect.DeepEqual(table.Routes, want) {
+			t.Errorf("%s: want %+v, have %+v", tc.name, want, table.Routes)
+		}
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	for _, tc := range []struct {
+		template, path string
+		want           map[string]string
+	}{
+		{"/v1/hello", "/v1/hello", map[string]string{}},
+		{"/v1/hello", "/v1/hello/", map[string]string{}},
+		{"/v1/hello/{name}", "/v1/hello/bob", map[string]string{"name": "bob"}},
+		{"/v1/agents/{agent_id}/calls/{call_id}", "/v1/agents/a1/calls/c2", map[string]string{"agent_id": "a1", "call_id": "c2"}},
+		{"/v1/hello/{name}", "/v1/hello", nil},
+		{"/v1/hello/{name}", "/v1/hello/bob/extra", nil},
+		{"/v1/hello/{name}", "/v1/world/bob", nil},
+	} {
+		params, ok := matchPath(splitPath(tc.template), splitPath(tc.path))
+		if ok != (tc.want != nil) || (ok && !reflect.DeepEqual(params, tc.want)) {
+			t.Errorf("%s against %s: want %v, have %v (%v)", tc.path, tc.template, tc.want, params, ok)
+		}
+	}
+}
+
+func TestSetMessageField(t *testing.T) {
+	for _, tc := range []struct {
+		name, value string
+		want        testRouteMessage
+		wantErr     bool
+	}{
+		{"agent_id", "a1", testRouteMessage{AgentId: "a1"}, false},
+		{"agentId", "a1", testRouteMessage{AgentId: "a1"}, false},
+		{"limit", "-10", testRouteMessage{Limit: -10}, false},
+		{"offset", "8589934592", testRouteMessage{Offset: 8589934592}, false},
+		{"count", "3", testRouteMessage{Count: 3}, false},
+		{"active", "true", testRouteMessage{Active: true}, false},
+		{"ratio", "0.5", testRouteMessage{Ratio: 0.5}, false},
+		{"limit", "8589934592", testRouteMessage{}, true},
+		{"count", "-1", testRouteMessage{}, true},
+		{"active", "maybe", testRouteMessage{}, true},
+		{"tags", "a", testRouteMessage{}, true},
+		{"task", "a", testRouteMessage{}, true},
+		{"unknown", "a", testRouteMessage{}, true},
+	} {
+		var msg testRouteMessage
+		err := setMessageField(&msg, tc.name, tc.value)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s=%s: want error %v, have %v", tc.name, tc.value, tc.wantErr, err)
+			continue
+		}
+		if !tc.wantErr && !reflect.DeepEqual(msg, tc.want) {
+			t.Errorf("%s=%s: want %+v, have %+v", tc.name, tc.value, tc.want, msg)
+		}
+	}
+}
+
+func TestDecodeHTTPRouteRequest(t *testing.T) {
+	requestType := reflect.TypeOf(&testRouteMessage{})
+
+	for _, tc := range []struct {
+		name     string
+		route    Route
+		target   string
+		body     string
+		want     testRouteMessage
+		wantCode codes.Code
+	}{
+		{
+			name:   "path wins over query and body",
+			route:  Route{Path: "/v1/agents/{id}", Fields: map[string]string{"id": "agent_id", "limit": "limit"}},
+			target: "/v1/agents/a1?id=a2&limit=5&ignored=1",
+			body:   `{"agent_id": "a3", "limit": 7, "active": true}`,
+			want:   testRouteMessage{AgentId: "a1", Limit: 5, Active: true},
+		},
+		{
+			name:   "body fills the fields not in the path or query",
+			route:  Route{Path: "/v1/agents/{id}", Fields: map[string]string{"id": "agent_id", "limit": "limit"}},
+			target: "/v1/agents/a1",
+			body:   `{"limit": 7, "tags": ["x"]}`,
+			want:   testRouteMessage{AgentId: "a1", Limit: 7, Tags: []string{"x"}},
+		},
+		{
+			name:   "body decoded into a field",
+			route:  Route{Path: "/v1/agents/{id}/tasks", Body: "task", Fields: map[string]string{"id": "agent_id"}},
+			target: "/v1/agents/a1/tasks",
+			body:   `{"agent_id": "t1", "count": 2}`,
+			want:   testRouteMessage{AgentId: "a1", Task: &testRouteMessage{AgentId: "t1", Count: 2}},
+		},
+		{
+			name:   "empty body",
+			route:  Route{Path: "/v1/agents", Fields: map[string]string{"limit": "limit"}},
+			target: "/v1/agents?limit=3",
+			want:   testRouteMessage{Limit: 3},
+		},
+		{
+			name:     "invalid parameter",
+			route:    Route{Path: "/v1/agents", Fields: map[string]string{"limit": "limit"}},
+			target:   "/v1/agents?limit=many",
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "invalid body",
+			route:    Route{Path: "/v1/agents"},
+			target:   "/v1/agents",
+			body:     `{"limit": "many"`,
+			wantCode: codes.InvalidArgument,
+		},
+	} {
+		r := httptest.NewRequest("POST", tc.target, strings.NewReader(tc.body))
+		params, ok := matchPath(splitPath(tc.route.Path), splitPath(r.URL.Path))
+		if !ok {
+			t.Fatalf("%s: %s does not match %s", tc.name, tc.target, tc.route.Path)
+		}
+		ctx := context.WithValue(context.Background(), routeParamsKey{}, params)
+
+		request, err := makeDecodeHTTPRouteRequest(tc.route, requestType)(ctx, r)
+		if tc.wantCode != codes.OK {
+			if grpc.Code(err) != tc.wantCode {
+				t.Errorf("%s: want %v, have %v", tc.name, tc.wantCode, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if have := request.(routeRequest).Message.(*testRouteMessage); !reflect.DeepEqual(*have, tc.want) {
+			t.Errorf("%s: want %+v, have %+v", tc.name, tc.want, *have)
+		}
+	}
+}
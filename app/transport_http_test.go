@@ -0,0 +1,165 @@
+package addsvc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/newtonsystems/grpc_types/go/grpc_types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestEncodeHTTPGenericResponseSuccess(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	err := EncodeHTTPGenericResponse(context.Background(), w, sayHelloResponse{Message: "Hello James"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := http.StatusOK, w.Code; want != have {
+		t.Errorf("want %d, have %d", want, have)
+	}
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "Hello James", body["Message"]; want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+	if _, ok := body["Err"]; ok {
+		t.Errorf("the error must not be part of a successful response, have %v", body)
+	}
+}
+
+func TestEncodeHTTPGenericResponseFailed(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	err := EncodeHTTPGenericResponse(context.Background(), w, sayHelloResponse{Err: status.Error(codes.NotFound, "no such person")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := http.StatusNotFound, w.Code; want != have {
+		t.Errorf("want %d, have %d", want, have)
+	}
+
+	var body errorWrapper
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "NotFound", body.Code; want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+	if want, have := "no such person", body.Message; want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
+
+func TestErrorEncoder(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{status.Error(codes.InvalidArgument, ""), http.StatusBadRequest},
+		{status.Error(codes.Unauthenticated, ""), http.StatusUnauthorized},
+		{status.Error(codes.Unavailable, ""), http.StatusServiceUnavailable},
+		{status.Error(codes.DeadlineExceeded, ""), http.StatusGatewayTimeout},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{http.ErrBodyNotAllowed, http.StatusInternalServerError},
+		{errRequestBodyTooLarge, http.StatusRequestEntityTooLarge},
+	} {
+		w := httptest.NewRecorder()
+		errorEncoder(context.Background(), tc.err, w)
+		if want, have := tc.code, w.Code; want != have {
+			t.Errorf("%v: want %d, have %d", tc.err, want, have)
+		}
+	}
+}
+
+func TestAllowMethods(t *testing.T) {
+	h := allowMethods(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "GET", "POST")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("DELETE", "/v1/ping", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("want 405, have %d", rec.Code)
+	}
+	if allow := rec.Header().Get("Allow"); allow != "GET, POST" {
+		t.Errorf("want Allow: GET, POST, have %q", allow)
+	}
+	var body errorWrapper
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Code != codes.Unimplemented.String() {
+		t.Errorf("want the Unimplemented code, have %q", body.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/v1/ping", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("want 200, have %d", rec.Code)
+	}
+}
+
+func TestLimitRequestBody(t *testing.T) {
+	h := limitRequestBody(httptransport.NewServer(
+		func(context.Context, interface{}) (interface{}, error) {
+			return sayHelloResponse{Message: "Hello"}, nil
+		},
+		decodeHTTPSayHelloRequest,
+		EncodeHTTPGenericResponse,
+		httptransport.ServerErrorEncoder(errorEncoder),
+	))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/v1/hello", strings.NewReader(`{"Name": "James"}`)))
+	if rec.Code != http.StatusOK {
+		t.Errorf("want 200, have %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	body := `{"Name": "` + strings.Repeat("a", maxRequestBodySize) + `"}`
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/v1/hello", strings.NewReader(body)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("want 413, have %d", rec.Code)
+	}
+	var wrapper errorWrapper
+	if err := json.NewDecoder(rec.Body).Decode(&wrapper); err != nil {
+		t.Fatal(err)
+	}
+	if wrapper.Code != codes.InvalidArgument.String() {
+		t.Errorf("want the InvalidArgument code, have %q", wrapper.Code)
+	}
+}
+
+func TestEncodeHTTPGenericResponseProto(t *testing.T) {
+	resp := &grpc_types.PingResponse{}
+	w := httptest.NewRecorder()
+	if err := EncodeHTTPGenericResponse(context.Background(), w, pingResponse{Response: resp}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The backend reply is encoded alone, the same as by the route table
+	want := httptest.NewRecorder()
+	if err := EncodeHTTPRouteResponse(context.Background(), want, routeResponse{Message: resp}); err != nil {
+		t.Fatal(err)
+	}
+	if w.Body.String() != want.Body.String() {
+		t.Errorf("want %s, have %s", want.Body.String(), w.Body.String())
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := body["Response"]; ok {
+		t.Errorf("want the reply unwrapped, have %v", body)
+	}
+}